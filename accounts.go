@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// pendingLinkTTL bounds how long a user has to confirm their password after
+// an OAuth login matched their account by email.
+const pendingLinkTTL = 10 * time.Minute
+
+type pendingLink struct {
+	MembershipID string
+	Identity     Identity
+}
+
+// savePendingLink remembers, in the browser session, an identity waiting to
+// be linked to user once they prove they own the account.
+func savePendingLink(w http.ResponseWriter, r *http.Request, user User, identity Identity) error {
+	session, _ := store.Get(r, sessionCookieName)
+	session.Values["link_membership_id"] = user.MembershipID
+	session.Values["link_provider"] = identity.Provider
+	session.Values["link_subject"] = identity.Subject
+	session.Values["link_email"] = identity.Email
+	session.Values["link_email_verified"] = identity.EmailVerified
+	session.Values["link_expires"] = time.Now().Add(pendingLinkTTL).Unix()
+	return session.Save(r, w)
+}
+
+func loadPendingLink(r *http.Request) (pendingLink, bool) {
+	session, _ := store.Get(r, sessionCookieName)
+	expires, _ := session.Values["link_expires"].(int64)
+	membershipID, _ := session.Values["link_membership_id"].(string)
+	if membershipID == "" || time.Now().Unix() > expires {
+		return pendingLink{}, false
+	}
+
+	link := pendingLink{MembershipID: membershipID}
+	link.Identity.Provider, _ = session.Values["link_provider"].(string)
+	link.Identity.Subject, _ = session.Values["link_subject"].(string)
+	link.Identity.Email, _ = session.Values["link_email"].(string)
+	link.Identity.EmailVerified, _ = session.Values["link_email_verified"].(bool)
+	return link, true
+}
+
+func clearPendingLink(w http.ResponseWriter, r *http.Request) error {
+	session, _ := store.Get(r, sessionCookieName)
+	for _, key := range []string{"link_membership_id", "link_provider", "link_subject", "link_email", "link_email_verified", "link_expires"} {
+		delete(session.Values, key)
+	}
+	return session.Save(r, w)
+}
+
+// linkHandler shows the password confirmation page for a pending link (GET)
+// and links the identity once the password checks out (POST).
+func linkHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := loadPendingLink(r)
+	if !ok {
+		http.Error(w, "No account link is pending", http.StatusBadRequest)
+		return
+	}
+
+	user, err := userStore.GetUserByMembershipID(link.MembershipID)
+	if err != nil {
+		log.Printf("Error loading user for pending link: %v", err)
+		http.Error(w, "No account link is pending", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data := struct {
+			Provider    string
+			Email       string
+			Username    string
+			HasPassword bool
+		}{
+			Provider:    link.Identity.Provider,
+			Email:       link.Identity.Email,
+			Username:    user.Username,
+			HasPassword: user.Password != "",
+		}
+		renderPage(w, r, "templates/link.html", data)
+	case http.MethodPost:
+		var body struct {
+			Password string `json:"password"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !checkLoginAllowed(w, r, &user) {
+			return
+		}
+		if user.Password == "" {
+			http.Error(w, noPasswordMessage, http.StatusForbidden)
+			return
+		}
+		ok, needsRehash := verifyPassword(body.Password, user.Password)
+		if !ok {
+			log.Printf("Password confirmation failed while linking %s identity to %s", link.Identity.Provider, user.Username)
+			recordLoginFailure(r, &user)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if clearGeneratedPassword(r, user, body.Password) {
+			http.Error(w, noPasswordMessage, http.StatusForbidden)
+			return
+		}
+		recordLoginSuccess(r, user)
+		if needsRehash {
+			upgradePasswordHash(user, body.Password)
+		}
+
+		link.Identity.UserID = user.ID
+		err = userStore.CreateIdentity(&link.Identity)
+		if err != nil && err != ErrIdentityExists {
+			log.Printf("Error linking identity: %v", err)
+			http.Error(w, "Error linking account", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Linked %s identity to user %s", link.Identity.Provider, user.Username)
+		verifyIdentityEmail(&user, link.Identity)
+
+		clearPendingLink(w, r)
+		needsSecondFactor, err := beginSignIn(w, r, user, "/welcome", false)
+		if err != nil {
+			http.Error(w, "Error creating session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":             "Account linked successfully",
+			"provider":            link.Identity.Provider,
+			"two_factor_required": needsSecondFactor,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// identitiesHandler lists the external identities linked to the signed-in
+// user.
+func identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	identities, err := userStore.ListIdentities(user.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving identities", http.StatusInternalServerError)
+		return
+	}
+	if identities == nil {
+		identities = []Identity{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+// unlinkIdentityHandler removes one linked identity. The last way of signing
+// in can't be removed: a user without a password or passkey keeps at least
+// one identity.
+func unlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	methods, err := signInMethods(user)
+	if err != nil {
+		http.Error(w, "Error retrieving identities", http.StatusInternalServerError)
+		return
+	}
+	if methods <= 1 {
+		http.Error(w, "Cannot unlink your only sign-in method", http.StatusConflict)
+		return
+	}
+
+	err = userStore.DeleteIdentity(user.ID, body.ID)
+	if err == ErrIdentityNotFound {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error unlinking identity: %v", err)
+		http.Error(w, "Error unlinking identity", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Unlinked identity %d from user %s", body.ID, user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Identity unlinked"})
+}
+
+// signInMethods counts the ways user can sign in: their password, linked
+// identities and passkeys.
+func signInMethods(user User) (int, error) {
+	identities, err := userStore.ListIdentities(user.ID)
+	if err != nil {
+		return 0, err
+	}
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	methods := len(identities) + len(passkeys)
+	if user.Password != "" {
+		methods++
+	}
+	return methods, nil
+}
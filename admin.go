@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// unlockHandler lifts a sign-in lockout before it expires, for an account
+// ({"username": "..."}) or a client address ({"ip": "..."}).
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := requestUser(r)
+
+	var body struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case body.Username != "":
+		user, err := userStore.GetUser(body.Username)
+		if err == ErrUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = unlockAccount(user, admin.Username, r)
+		}
+		if err != nil {
+			log.Printf("Error unlocking account: %v", err)
+			http.Error(w, "Error unlocking account", http.StatusInternalServerError)
+			return
+		}
+	case body.IP != "":
+		err = unlockIP(body.IP, admin.Username, r)
+		if err != nil {
+			log.Printf("Error unlocking address: %v", err)
+			http.Error(w, "Error unlocking address", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Username or IP is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Unlocked"})
+}
+
+// revokeUserSessionsHandler signs a user out of every session
+// ({"username": "..."}).
+func revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := requestUser(r)
+
+	var body struct {
+		Username string `json:"username"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := userStore.GetUser(body.Username)
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = userStore.InvalidateSessions(user.ID)
+	}
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditSessionsRevoked, user.ID, admin.Username, r, "all sessions of "+user.Username+" revoked")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Sessions revoked"})
+}
+
+func unlockAccount(user User, actor string, r *http.Request) error {
+	err := userStore.ClearLoginFailures(loginScopeAccount, strconv.Itoa(user.ID))
+	if err != nil {
+		return err
+	}
+	recordAudit(auditAccountUnlocked, user.ID, actor, r, "account "+user.Username+" unlocked")
+	return nil
+}
+
+func unlockIP(ip, actor string, r *http.Request) error {
+	err := userStore.ClearLoginFailures(loginScopeIP, ip)
+	if err != nil {
+		return err
+	}
+	recordAudit(auditIPUnlocked, 0, actor, r, "ip "+ip+" unlocked")
+	return nil
+}
+
+// runUnlockCommand implements "unlock <username>" and "unlock -ip <address>",
+// for operators who can't sign in as an admin.
+func runUnlockCommand(args []string) error {
+	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	ip := flags.String("ip", "", "unlock a client address instead of an account")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *ip == "" && flags.NArg() != 1 {
+		return fmt.Errorf("usage: unlock <username> | unlock -ip <address>")
+	}
+
+	err = initStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	if *ip != "" {
+		err = unlockIP(*ip, "cli", nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Unlocked %s\n", *ip)
+		return nil
+	}
+
+	user, err := userStore.GetUser(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error finding user %s: %v", flags.Arg(0), err)
+	}
+	err = unlockAccount(user, "cli", nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Unlocked %s\n", user.Username)
+	return nil
+}
+
+// passwordReportHandler returns the counts of stored password hashes by
+// algorithm, including how many legacy hashes are still waiting for their
+// owner's next sign-in.
+func passwordReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := reportPasswordHashes()
+	if err != nil {
+		log.Printf("Error reporting password hashes: %v", err)
+		http.Error(w, "Error reporting password hashes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runPasswordReportCommand implements "password-report", which prints the
+// same counts as passwordReportHandler.
+func runPasswordReportCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: password-report")
+	}
+
+	err := initPasswordHasher()
+	if err != nil {
+		return err
+	}
+	err = initStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	report, err := reportPasswordHashes()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d password hashes (current algorithm %s)\n", report.Total, passwordHasher.Name())
+	for _, verifier := range passwordVerifiers {
+		if n := report.Algorithms[verifier.Name()]; n > 0 {
+			fmt.Printf("  %-14s %d\n", verifier.Name(), n)
+		}
+	}
+	if report.Unrecognised > 0 {
+		fmt.Printf("  %-14s %d\n", "unrecognised", report.Unrecognised)
+	}
+	fmt.Printf("Legacy hashes remaining: %d\n", report.Legacy)
+	fmt.Printf("Hashes to upgrade at next sign-in: %d\n", report.Outdated)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// Audit event types.
+const (
+	auditAccountLocked            = "account_locked"
+	auditAccountUnlocked          = "account_unlocked"
+	auditIPLocked                 = "ip_locked"
+	auditIPUnlocked               = "ip_unlocked"
+	auditPasswordChanged          = "password_changed"
+	auditPasswordSet              = "password_set"
+	auditPasswordReset            = "password_reset"
+	auditGeneratedPasswordCleared = "generated_password_cleared"
+	auditSessionRevoked           = "session_revoked"
+	auditSessionsRevoked          = "sessions_revoked"
+	auditPersistentLoginRevoked   = "persistent_login_revoked"
+	auditRoleGranted              = "role_granted"
+	auditRoleRevoked              = "role_revoked"
+	auditAccountSuspended         = "account_suspended"
+	auditAccountReactivated       = "account_reactivated"
+	auditPasswordResetForced      = "password_reset_forced"
+	auditTwoFactorRemoved         = "two_factor_removed"
+	auditAccountDeleted           = "account_deleted"
+)
+
+// recordAudit stores an audit event. r, if not nil, supplies the client
+// address. A failure is logged rather than returned: losing an audit event
+// shouldn't fail the action it describes.
+func recordAudit(eventType string, userID int, actor string, r *http.Request, details string) {
+	event := AuditEvent{
+		Type:    eventType,
+		UserID:  userID,
+		Actor:   actor,
+		Details: details,
+	}
+	if r != nil {
+		event.IPAddress = clientIP(r)
+	}
+
+	err := userStore.RecordAuditEvent(&event)
+	if err != nil {
+		log.Printf("Error recording %s audit event: %v", eventType, err)
+		return
+	}
+	log.Printf("Audit: %s user=%d actor=%q ip=%s %s", eventType, userID, actor, event.IPAddress, details)
+}
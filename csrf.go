@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfSessionKey holds the session's synchronizer token. A new session
+	// (e.g. after sign-in) gets a new token.
+	csrfSessionKey = "csrf_token"
+	// csrfHeader and csrfFormField carry the token in a request: scripts
+	// send the header (static/csrf.js adds it to fetch), plain forms the
+	// field.
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// csrfToken returns the synchronizer token of r's session, creating and
+// saving one if needed. It must be called before the response is written.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, _ := store.Get(r, sessionCookieName)
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token, nil
+	}
+
+	token := generateRandomToken(32)
+	session.Values[csrfSessionKey] = token
+	err := session.Save(r, w)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// csrfTemplateFuncs gives templates {{csrfToken}}, for the csrf-token meta
+// tag that static/csrf.js reads and for csrf_token fields in plain forms.
+func csrfTemplateFuncs(w http.ResponseWriter, r *http.Request) (template.FuncMap, error) {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return template.FuncMap{
+		"csrfToken": func() string { return token },
+	}, nil
+}
+
+// withCSRFProtection refuses state-changing requests (anything but GET,
+// HEAD, OPTIONS and TRACE) that come from another site or don't carry the
+// session's synchronizer token.
+//
+// Requests with a bearer Authorization header are exempt: a browser won't
+// send one cross-site without a CORS preflight, which this server never
+// allows, so they can't be forged by another page.
+func withCSRFProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isBearerRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOriginRequest(r) {
+			log.Printf("CSRF check failed for %s %s: cross-site request from origin %q, referer %q",
+				r.Method, r.URL.Path, r.Header.Get("Origin"), r.Header.Get("Referer"))
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if !validCSRFToken(r) {
+			log.Printf("CSRF check failed for %s %s: missing or invalid token", r.Method, r.URL.Path)
+			http.Error(w, "Invalid or expired form; please reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isBearerRequest(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Bearer")
+}
+
+// sameOriginRequest checks r's Origin header, or failing that its Referer,
+// against this server: the host the request was sent to or the host of
+// PUBLIC_BASE_URL. A request with neither header passes; the token check
+// still applies to it.
+func sameOriginRequest(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+		if source == "" {
+			return true
+		}
+	}
+	if source == "null" {
+		return false
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	base, err := url.Parse(publicURL("/"))
+	return err == nil && strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+}
+
+// validCSRFToken reports whether r carries its session's token, in the
+// X-CSRF-Token header or a csrf_token form field.
+func validCSRFToken(r *http.Request) bool {
+	session, _ := store.Get(r, sessionCookieName)
+	expected, _ := session.Values[csrfSessionKey].(string)
+	if expected == "" {
+		return false
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		// Only read the body for form posts; JSON handlers decode it
+		// themselves
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+			token = r.PostFormValue(csrfFormField)
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
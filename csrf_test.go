@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfSession starts a session the way a page view does and returns its
+// cookie and synchronizer token.
+func csrfSession(t *testing.T) (*http.Cookie, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	token, err := csrfToken(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := responseCookie(w, sessionCookieName)
+	if cookie == nil || token == "" {
+		t.Fatal("no session or token")
+	}
+	return cookie, token
+}
+
+func TestCSRFProtection(t *testing.T) {
+	setupTestServer(t)
+	t.Setenv("PUBLIC_BASE_URL", "https://accounts.example.org")
+	cookie, token := csrfSession(t)
+	otherCookie, otherToken := csrfSession(t)
+	protected := withCSRFProtection(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	form := url.Values{csrfFormField: {token}}.Encode()
+	for _, test := range []struct {
+		name        string
+		method      string
+		cookie      *http.Cookie
+		headers     map[string]string
+		body        string
+		contentType string
+		allowed     bool
+	}{
+		{name: "GET needs no token", method: http.MethodGet, allowed: true},
+		{name: "HEAD needs no token", method: http.MethodHead, allowed: true},
+		{name: "POST without a token", method: http.MethodPost, cookie: cookie},
+		{name: "POST without a session", method: http.MethodPost, headers: map[string]string{csrfHeader: token}},
+		{name: "token in the header", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token}, allowed: true},
+		{name: "token in a form field", method: http.MethodPost, cookie: cookie, body: form, contentType: "application/x-www-form-urlencoded", allowed: true},
+		{name: "token in a JSON body", method: http.MethodPost, cookie: cookie, body: `{"csrf_token":"` + token + `"}`, contentType: "application/json"},
+		{name: "wrong token", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token + "x"}},
+		{name: "another session's token", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: otherToken}},
+		{name: "DELETE without a token", method: http.MethodDelete, cookie: otherCookie},
+		{name: "same origin", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Origin": "http://example.com"}, allowed: true},
+		{name: "public base URL origin", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Origin": "https://accounts.example.org"}, allowed: true},
+		{name: "public base URL host with another scheme", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Origin": "http://accounts.example.org"}},
+		{name: "cross-site origin with the token", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Origin": "https://evil.example.net"}},
+		{name: "null origin", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Origin": "null"}},
+		{name: "cross-site referer", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Referer": "https://evil.example.net/page"}},
+		{name: "same-site referer", method: http.MethodPost, cookie: cookie, headers: map[string]string{csrfHeader: token, "Referer": "http://example.com/welcome"}, allowed: true},
+		{name: "bearer request", method: http.MethodPost, headers: map[string]string{"Authorization": "Bearer abc"}, allowed: true},
+		{name: "basic auth isn't exempt", method: http.MethodPost, headers: map[string]string{"Authorization": "Basic YTpi"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/account/password", strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			if test.cookie != nil {
+				r.AddCookie(test.cookie)
+			}
+			w := httptest.NewRecorder()
+			protected.ServeHTTP(w, r)
+
+			if allowed := w.Code == http.StatusNoContent; allowed != test.allowed {
+				t.Fatalf("got %d %s, want allowed %v", w.Code, w.Body, test.allowed)
+			}
+			if !test.allowed && w.Code != http.StatusForbidden {
+				t.Fatalf("got %d, want 403", w.Code)
+			}
+		})
+	}
+}
+
+func TestCSRFTokenIsStablePerSession(t *testing.T) {
+	setupTestServer(t)
+	cookie, token := csrfSession(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	again, err := csrfToken(httptest.NewRecorder(), r)
+	if err != nil || again != token {
+		t.Fatalf("second page view got token %q, err %v; want %q", again, err, token)
+	}
+	if _, other := csrfSession(t); other == token {
+		t.Fatal("two sessions got the same token")
+	}
+}
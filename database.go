@@ -2,16 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var db *sql.DB
 
-func initDB() error {
+func openDB() error {
 	var err error
 	connStr := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
 		os.Getenv("DB_USER"),
@@ -28,119 +31,1007 @@ func initDB() error {
 	}
 
 	log.Println("Successfully connected to the database")
+	return nil
+}
 
-	// Create users table if not exists
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			membership_id CHAR(16) UNIQUE,
-			username VARCHAR(50) UNIQUE NOT NULL,
-			password VARCHAR(100) NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+func initDB() error {
+	err := openDB()
 	if err != nil {
 		return err
 	}
 
-	// Add membership_id column if it doesn't exist
-	_, err = db.Exec(`
-		DO $$ 
-		BEGIN 
-			IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='users' AND column_name='membership_id') THEN
-				ALTER TABLE users ADD COLUMN membership_id CHAR(16) UNIQUE;
-			END IF;
-		END $$;
-	`)
+	// Schema changes live in migrations/ and are applied by the migration
+	// runner. Set DB_AUTO_MIGRATE=false to manage them with `migrate up`.
+	if os.Getenv("DB_AUTO_MIGRATE") == "false" {
+		log.Println("Skipping automatic migrations (DB_AUTO_MIGRATE=false)")
+		return nil
+	}
+
+	applied, err := migrateUp(db, false)
 	if err != nil {
-		return err
+		return fmt.Errorf("error applying migrations: %v", err)
 	}
+	log.Printf("Database schema is up to date (%d migrations applied)", len(applied))
+
+	return nil
+}
+
+// postgresStore implements UserStore on top of the lib/pq connection.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
 
-	// Update existing records with a membership_id if they don't have one
-	rows, err := db.Query("SELECT id FROM users WHERE membership_id IS NULL")
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// userNamesLockID is the pg_advisory_xact_lock key held while a username
+// or email is written, so that two writes can't both pass
+// checkCrossConflict before either commits.
+const userNamesLockID = 727384652
+
+// CreateUser doesn't log; callers do, so a bulk import doesn't flood the log.
+func (s *postgresStore) CreateUser(user *User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = checkCrossConflict(tx, *user)
 	if err != nil {
 		return err
 	}
+
+	err = tx.QueryRow("INSERT INTO users (membership_id, username, email, email_verified_at, password) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		user.MembershipID, user.Username, nullString(user.Email), user.EmailVerifiedAt, nullString(user.Password)).Scan(&user.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("error creating user: %w", err)
+	}
+	return tx.Commit()
+}
+
+// checkCrossConflict returns ErrUserExists if another user has an email
+// equal to user's username, or a username equal to its email. The unique
+// indexes only compare like with like, and lookups accept either. It takes
+// the userNamesLockID lock for the rest of tx, which must then write user.
+func checkCrossConflict(tx *sql.Tx, user User) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", userNamesLockID)
+	if err != nil {
+		return fmt.Errorf("error locking usernames: %w", err)
+	}
+
+	var taken bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id <> $1 AND (lower(email) = lower($2) OR lower(username) = lower($3)))`,
+		user.ID, user.Username, user.Email).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("error checking username and email: %w", err)
+	}
+	if taken {
+		return ErrUserExists
+	}
+	return nil
+}
+
+const userColumns = "users.id, users.membership_id, users.username, users.email, users.email_verified_at, users.password, users.session_epoch, users.totp_secret, users.totp_enabled_at IS NOT NULL, users.suspended_at, users.suspension_reason"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	var email, password, totpSecret, suspensionReason sql.NullString
+	var emailVerifiedAt, suspendedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.MembershipID, &user.Username, &email, &emailVerifiedAt, &password, &user.SessionEpoch, &totpSecret, &user.TwoFactorEnabled, &suspendedAt, &suspensionReason)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.Email = email.String
+	user.EmailVerifiedAt = nullTimePtr(emailVerifiedAt)
+	user.Password = password.String
+	user.TOTPSecret = totpSecret.String
+	user.SuspendedAt = nullTimePtr(suspendedAt)
+	user.SuspensionReason = suspensionReason.String
+	return user, nil
+}
+
+func (s *postgresStore) GetUser(usernameOrEmail string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1 OR lower(email) = lower($1) ORDER BY username = $1 DESC LIMIT 1", usernameOrEmail))
+}
+
+func (s *postgresStore) GetUserByID(id int) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s *postgresStore) GetUserByMembershipID(membershipID string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE membership_id = $1", membershipID))
+}
+
+func (s *postgresStore) GetUserByIdentity(provider, subject string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users JOIN user_identities ON user_identities.user_id = users.id WHERE user_identities.provider = $1 AND user_identities.subject = $2", provider, subject))
+}
+
+func (s *postgresStore) ListUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT id, membership_id, username, email, email_verified_at, totp_enabled_at IS NOT NULL, suspended_at, suspension_reason FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
+	var users []User
 	for rows.Next() {
-		var id int
-		err := rows.Scan(&id)
+		var user User
+		var email, suspensionReason sql.NullString
+		var emailVerifiedAt, suspendedAt sql.NullTime
+		err := rows.Scan(&user.ID, &user.MembershipID, &user.Username, &email, &emailVerifiedAt, &user.TwoFactorEnabled, &suspendedAt, &suspensionReason)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		user.Email = email.String
+		user.EmailVerifiedAt = nullTimePtr(emailVerifiedAt)
+		user.SuspendedAt = nullTimePtr(suspendedAt)
+		user.SuspensionReason = suspensionReason.String
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (s *postgresStore) ListPasswordHashes() ([]string, error) {
+	rows, err := s.db.Query("SELECT password FROM users WHERE password IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		membershipID := generateMembershipID()
-		_, err = db.Exec("UPDATE users SET membership_id = $1 WHERE id = $2", membershipID, id)
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		err := rows.Scan(&hash)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+func (s *postgresStore) UpdateUser(user User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	// Make membership_id NOT NULL after updating existing records
-	_, err = db.Exec(`
-		ALTER TABLE users ALTER COLUMN membership_id SET NOT NULL
-	`)
+	err = checkCrossConflict(tx, user)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`UPDATE users SET username = $1, email = $2, password = $3,
+		email_verified_at = CASE WHEN lower(email) IS DISTINCT FROM lower($2) THEN NULL ELSE email_verified_at END
+		WHERE id = $4`,
+		user.Username, nullString(user.Email), nullString(user.Password), user.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	err = expectOneRow(result, ErrUserNotFound)
 	if err != nil {
 		return err
 	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) MarkEmailVerified(userID int, email string) error {
+	result, err := s.db.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, $3) WHERE id = $1 AND lower(email) = lower($2)", userID, email, time.Now())
+	if err != nil {
+		return fmt.Errorf("error marking email verified: %w", err)
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+func (s *postgresStore) DeleteUser(id int) error {
+	result, err := s.db.Exec("DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %w", err)
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+func (s *postgresStore) SuspendUser(userID int, reason string) error {
+	result, err := s.db.Exec("UPDATE users SET suspended_at = COALESCE(suspended_at, $2), suspension_reason = $3 WHERE id = $1", userID, time.Now(), reason)
+	if err != nil {
+		return fmt.Errorf("error suspending user: %w", err)
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+func (s *postgresStore) ReactivateUser(userID int) error {
+	result, err := s.db.Exec("UPDATE users SET suspended_at = NULL, suspension_reason = NULL WHERE id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error reactivating user: %w", err)
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+func (s *postgresStore) CreateIdentity(identity *Identity) error {
+	err := s.db.QueryRow("INSERT INTO user_identities (user_id, provider, subject, email, email_verified) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		identity.UserID, identity.Provider, identity.Subject, nullString(identity.Email), identity.EmailVerified).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrIdentityExists
+		}
+		return fmt.Errorf("error creating identity: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ListIdentities(userID int) ([]Identity, error) {
+	rows, err := s.db.Query("SELECT id, user_id, provider, subject, email, email_verified, created_at FROM user_identities WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var identity Identity
+		var email sql.NullString
+		err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &email, &identity.EmailVerified, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		identity.Email = email.String
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+func (s *postgresStore) DeleteIdentity(userID, id int) error {
+	result, err := s.db.Exec("DELETE FROM user_identities WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting identity: %w", err)
+	}
+	return expectOneRow(result, ErrIdentityNotFound)
+}
+
+func (s *postgresStore) InvalidateSessions(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET session_epoch = session_epoch + 1 WHERE id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error invalidating sessions: %w", err)
+	}
+	err = expectOneRow(result, ErrUserNotFound)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM persistent_logins WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error deleting persistent logins: %w", err)
+	}
+	return tx.Commit()
+}
+
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+const sessionColumns = "id, token_hash, user_id, data, user_agent, ip_address, created_at, last_seen_at, expires_at"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (SessionRecord, error) {
+	var session SessionRecord
+	var userID sql.NullInt64
+	err := row.Scan(&session.ID, &session.TokenHash, &userID, &session.Data, &session.UserAgent, &session.IPAddress,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	session.UserID = int(userID.Int64)
+	return session, err
+}
+
+func (s *postgresStore) CreateSession(session *SessionRecord) error {
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	err := s.db.QueryRow(`INSERT INTO sessions (token_hash, user_id, data, user_agent, ip_address, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7) RETURNING id`,
+		session.TokenHash, nullInt(session.UserID), session.Data, session.UserAgent, session.IPAddress, now, session.ExpiresAt).Scan(&session.ID)
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetSession(tokenHash string) (SessionRecord, error) {
+	session, err := scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = $1 AND expires_at > $2", tokenHash, time.Now()))
+	if err == sql.ErrNoRows {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return SessionRecord{}, fmt.Errorf("error getting session: %w", err)
+	}
+	return session, nil
+}
+
+func (s *postgresStore) UpdateSession(session SessionRecord) error {
+	result, err := s.db.Exec("UPDATE sessions SET user_id = $2, data = $3, expires_at = $4 WHERE token_hash = $1 AND expires_at > $5",
+		session.TokenHash, nullInt(session.UserID), session.Data, session.ExpiresAt, time.Now())
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+	return expectOneRow(result, ErrSessionNotFound)
+}
+
+func (s *postgresStore) TouchSession(tokenHash, ipAddress, userAgent string, expiresAt time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET last_seen_at = $2, ip_address = $3, user_agent = $4, expires_at = $5 WHERE token_hash = $1",
+		tokenHash, time.Now(), ipAddress, userAgent, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error touching session: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ListSessions(userID int) ([]SessionRecord, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND expires_at > $2 ORDER BY last_seen_at DESC", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []SessionRecord
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *postgresStore) DeleteSession(userID, id int) error {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return expectOneRow(result, ErrSessionNotFound)
+}
+
+func (s *postgresStore) DeleteSessionByToken(tokenHash string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) DeleteExpiredSessions() (int64, error) {
+	var deleted int64
+	for _, table := range []string{"sessions", "persistent_logins", "used_oauth_states"} {
+		result, err := s.db.Exec("DELETE FROM "+table+" WHERE expires_at <= $1", time.Now())
+		if err != nil {
+			return deleted, fmt.Errorf("error deleting expired %s: %w", table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, fmt.Errorf("error getting rows affected: %w", err)
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+const persistentLoginColumns = "id, token_hash, user_id, user_agent, ip_address, created_at, last_used_at, expires_at"
+
+func scanPersistentLogin(row interface{ Scan(...interface{}) error }) (PersistentLogin, error) {
+	var login PersistentLogin
+	err := row.Scan(&login.ID, &login.TokenHash, &login.UserID, &login.UserAgent, &login.IPAddress,
+		&login.CreatedAt, &login.LastUsedAt, &login.ExpiresAt)
+	return login, err
+}
+
+func (s *postgresStore) CreatePersistentLogin(login *PersistentLogin) error {
+	now := time.Now()
+	login.CreatedAt = now
+	login.LastUsedAt = now
+	err := s.db.QueryRow(`INSERT INTO persistent_logins (token_hash, user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $5, $6) RETURNING id`,
+		login.TokenHash, login.UserID, login.UserAgent, login.IPAddress, now, login.ExpiresAt).Scan(&login.ID)
+	if err != nil {
+		return fmt.Errorf("error creating persistent login: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetPersistentLogin(tokenHash string) (PersistentLogin, error) {
+	login, err := scanPersistentLogin(s.db.QueryRow("SELECT "+persistentLoginColumns+" FROM persistent_logins WHERE token_hash = $1 AND expires_at > $2", tokenHash, time.Now()))
+	if err == sql.ErrNoRows {
+		return PersistentLogin{}, ErrLoginNotFound
+	}
+	if err != nil {
+		return PersistentLogin{}, fmt.Errorf("error getting persistent login: %w", err)
+	}
+	return login, nil
+}
+
+func (s *postgresStore) TouchPersistentLogin(id int, ipAddress, userAgent string) error {
+	_, err := s.db.Exec("UPDATE persistent_logins SET last_used_at = $2, ip_address = $3, user_agent = $4 WHERE id = $1",
+		id, time.Now(), ipAddress, userAgent)
+	if err != nil {
+		return fmt.Errorf("error touching persistent login: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ListPersistentLogins(userID int) ([]PersistentLogin, error) {
+	rows, err := s.db.Query("SELECT "+persistentLoginColumns+" FROM persistent_logins WHERE user_id = $1 AND expires_at > $2 ORDER BY last_used_at DESC", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logins []PersistentLogin
+	for rows.Next() {
+		login, err := scanPersistentLogin(rows)
+		if err != nil {
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+
+	return logins, rows.Err()
+}
+
+func (s *postgresStore) DeletePersistentLogin(userID, id int) error {
+	result, err := s.db.Exec("DELETE FROM persistent_logins WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting persistent login: %w", err)
+	}
+	return expectOneRow(result, ErrLoginNotFound)
+}
 
+func (s *postgresStore) DeletePersistentLoginByToken(tokenHash string) error {
+	_, err := s.db.Exec("DELETE FROM persistent_logins WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return fmt.Errorf("error deleting persistent login: %w", err)
+	}
 	return nil
 }
 
-func createUser(membershipID, username, password string) error {
-	log.Printf("Attempting to create user: %s with membership ID: %s\n", username, membershipID)
+func (s *postgresStore) ListUserRoles(userID int) ([]string, error) {
+	return s.queryStrings("SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = $1 ORDER BY r.name", userID)
+}
+
+func (s *postgresStore) ListUserPermissions(userID int) ([]string, error) {
+	return s.queryStrings("SELECT DISTINCT rp.permission FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id WHERE ur.user_id = $1 ORDER BY rp.permission", userID)
+}
+
+// queryStrings runs a query selecting one text column and returns its
+// values.
+func (s *postgresStore) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err := rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+func (s *postgresStore) AssignRole(userID int, role string) error {
+	var roleID int
+	err := s.db.QueryRow("SELECT id FROM roles WHERE name = $1", role).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return ErrRoleNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error getting role: %w", err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, roleID)
+	if err != nil {
+		return fmt.Errorf("error assigning role: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) RemoveRole(userID int, role string) error {
+	_, err := s.db.Exec("DELETE FROM user_roles WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)", userID, role)
+	if err != nil {
+		return fmt.Errorf("error removing role: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) CountUsersWithRole(role string) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = $1", role).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting users with role: %w", err)
+	}
+	return count, nil
+}
+
+func (s *postgresStore) CreateToken(token *AccountToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM account_tokens WHERE user_id = $1 AND purpose = $2 AND consumed_at IS NULL", token.UserID, token.Purpose)
+	if err != nil {
+		return fmt.Errorf("error discarding old tokens: %w", err)
+	}
+
+	err = tx.QueryRow("INSERT INTO account_tokens (user_id, purpose, token_hash, email, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		token.UserID, token.Purpose, token.TokenHash, nullString(token.Email), token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating token: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) ConsumeToken(purpose, tokenHash string) (AccountToken, error) {
+	var token AccountToken
+	var email sql.NullString
+	var consumedAt time.Time
+	err := s.db.QueryRow(`UPDATE account_tokens SET consumed_at = $3
+		WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > $3
+		RETURNING id, user_id, purpose, token_hash, email, expires_at, consumed_at, created_at`,
+		tokenHash, purpose, time.Now()).Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &email, &token.ExpiresAt, &consumedAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return AccountToken{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return AccountToken{}, fmt.Errorf("error consuming token: %w", err)
+	}
+	token.Email = email.String
+	token.ConsumedAt = &consumedAt
+	return token, nil
+}
+
+func (s *postgresStore) UseOAuthState(stateHash string, expiresAt time.Time) error {
+	result, err := s.db.Exec(`INSERT INTO used_oauth_states (state_hash, expires_at) VALUES ($1, $2)
+		ON CONFLICT (state_hash) DO NOTHING`, stateHash, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error recording oauth state: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+func (s *postgresStore) GetToken(purpose, tokenHash string) (AccountToken, error) {
+	var token AccountToken
+	var email sql.NullString
+	err := s.db.QueryRow(`SELECT id, user_id, purpose, token_hash, email, expires_at, created_at FROM account_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > $3`,
+		tokenHash, purpose, time.Now()).Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &email, &token.ExpiresAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return AccountToken{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return AccountToken{}, fmt.Errorf("error getting token: %w", err)
+	}
+	token.Email = email.String
+	return token, nil
+}
+
+func (s *postgresStore) LastTokenCreatedAt(userID int, purpose string) (time.Time, error) {
+	var createdAt sql.NullTime
+	err := s.db.QueryRow("SELECT max(created_at) FROM account_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose).Scan(&createdAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting last token: %w", err)
+	}
+	return createdAt.Time, nil
+}
+
+func (s *postgresStore) EnqueueEmail(email *QueuedEmail) error {
+	email.Status = mailStatusPending
+	err := s.db.QueryRow("INSERT INTO mail_queue (recipient, subject, text_body, html_body) VALUES ($1, $2, $3, $4) RETURNING id, next_attempt_at, created_at",
+		email.Email.To, email.Email.Subject, email.Email.Text, email.Email.HTML).Scan(&email.ID, &email.NextAttemptAt, &email.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error queueing email: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ClaimEmails(limit int, lease time.Duration) ([]QueuedEmail, error) {
+	now := time.Now()
+	// SKIP LOCKED lets several instances run workers without sending the
+	// same message twice.
+	rows, err := s.db.Query(`UPDATE mail_queue SET attempts = attempts + 1, next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM mail_queue
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, subject, text_body, html_body, status, attempts, next_attempt_at, created_at`,
+		now, now.Add(lease), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming emails: %w", err)
+	}
+	defer rows.Close()
+
+	var emails []QueuedEmail
+	for rows.Next() {
+		var email QueuedEmail
+		err := rows.Scan(&email.ID, &email.Email.To, &email.Email.Subject, &email.Email.Text, &email.Email.HTML,
+			&email.Status, &email.Attempts, &email.NextAttemptAt, &email.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+func (s *postgresStore) MarkEmailSent(id int) error {
+	result, err := s.db.Exec("UPDATE mail_queue SET status = 'sent', sent_at = $2, last_error = NULL, text_body = '', html_body = '' WHERE id = $1", id, time.Now())
+	if err != nil {
+		return fmt.Errorf("error marking email sent: %w", err)
+	}
+	return expectOneRow(result, fmt.Errorf("queued email %d not found", id))
+}
+
+func (s *postgresStore) MarkEmailFailed(id int, lastError string, retryAt time.Time) error {
 	var result sql.Result
 	var err error
-
-	if password == "" {
-		log.Println("Creating user without password (OAuth)")
-		result, err = db.Exec("INSERT INTO users (membership_id, username, password) VALUES ($1, $2, NULL)", membershipID, username)
+	if retryAt.IsZero() {
+		result, err = s.db.Exec("UPDATE mail_queue SET status = 'failed', last_error = $2, text_body = '', html_body = '' WHERE id = $1", id, lastError)
 	} else {
-		log.Println("Creating user with password")
-		result, err = db.Exec("INSERT INTO users (membership_id, username, password) VALUES ($1, $2, $3)", membershipID, username, password)
+		result, err = s.db.Exec("UPDATE mail_queue SET next_attempt_at = $3, last_error = $2 WHERE id = $1", id, lastError, retryAt)
+	}
+	if err != nil {
+		return fmt.Errorf("error recording failed email: %w", err)
 	}
+	return expectOneRow(result, fmt.Errorf("queued email %d not found", id))
+}
 
+func (s *postgresStore) SetTOTPSecret(userID int, secret string) error {
+	result, err := s.db.Exec("UPDATE users SET totp_secret = $2, totp_enabled_at = NULL WHERE id = $1", userID, secret)
 	if err != nil {
-		log.Printf("Error creating user: %v\n", err)
-		return fmt.Errorf("error creating user: %w", err)
+		return fmt.Errorf("error setting TOTP secret: %w", err)
 	}
+	return expectOneRow(result, ErrUserNotFound)
+}
 
-	rowsAffected, err := result.RowsAffected()
+func (s *postgresStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Printf("Error getting rows affected: %v\n", err)
-		return fmt.Errorf("error getting rows affected: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET totp_enabled_at = $2 WHERE id = $1 AND totp_secret IS NOT NULL", userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("error enabling TOTP: %w", err)
+	}
+	err = expectOneRow(result, ErrUserNotFound)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("User created successfully. Rows affected: %d\n", rowsAffected)
+	err = replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) DisableTOTP(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL WHERE id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error disabling TOTP: %w", err)
+	}
+	err = expectOneRow(result, ErrUserNotFound)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(tx, userID, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) UseTOTPStep(userID int, step int64) error {
+	result, err := s.db.Exec("UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2", userID, step)
+	if err != nil {
+		return fmt.Errorf("error recording TOTP step: %w", err)
+	}
+	return expectOneRow(result, ErrCodeInvalid)
+}
+
+func (s *postgresStore) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(tx, userID, codeHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, codeHash)
+		if err != nil {
+			return fmt.Errorf("error storing recovery code: %w", err)
+		}
+	}
 	return nil
 }
 
-func getUser(usernameOrEmail string) (User, error) {
-	var user User
-	err := db.QueryRow("SELECT id, membership_id, username, password FROM users WHERE username = $1 OR username = $1", usernameOrEmail).Scan(&user.ID, &user.MembershipID, &user.Username, &user.Password)
+func (s *postgresStore) UseRecoveryCode(userID int, codeHash string) error {
+	result, err := s.db.Exec("UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userID, codeHash, time.Now())
 	if err != nil {
-		return User{}, err
+		return fmt.Errorf("error using recovery code: %w", err)
 	}
-	return user, nil
+	return expectOneRow(result, ErrCodeInvalid)
+}
+
+func (s *postgresStore) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+const passkeyColumns = "id, user_id, name, credential_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state, last_used_at, created_at"
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (Passkey, error) {
+	var passkey Passkey
+	var transports string
+	var signCount int64
+	var lastUsedAt sql.NullTime
+	err := row.Scan(&passkey.ID, &passkey.UserID, &passkey.Name, &passkey.CredentialID, &passkey.PublicKey, &passkey.AttestationType,
+		&transports, &passkey.AAGUID, &signCount, &passkey.BackupEligible, &passkey.BackupState, &lastUsedAt, &passkey.CreatedAt)
+	if err != nil {
+		return Passkey{}, err
+	}
+	passkey.Transports = splitList(transports)
+	passkey.SignCount = uint32(signCount)
+	passkey.LastUsedAt = nullTimePtr(lastUsedAt)
+	return passkey, nil
 }
 
-func getAllUsers() ([]User, error) {
-	rows, err := db.Query("SELECT membership_id, username FROM users")
+func (s *postgresStore) CreatePasskey(passkey *Passkey) error {
+	err := s.db.QueryRow("INSERT INTO webauthn_credentials (user_id, name, credential_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at",
+		passkey.UserID, passkey.Name, passkey.CredentialID, passkey.PublicKey, passkey.AttestationType, strings.Join(passkey.Transports, ","),
+		passkey.AAGUID, int64(passkey.SignCount), passkey.BackupEligible, passkey.BackupState).Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrPasskeyExists
+		}
+		return fmt.Errorf("error creating passkey: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ListPasskeys(userID int) ([]Passkey, error) {
+	rows, err := s.db.Query("SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE user_id = $1 ORDER BY id", userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
+	var passkeys []Passkey
 	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.MembershipID, &user.Username)
+		passkey, err := scanPasskey(rows)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+func (s *postgresStore) GetPasskeyByCredentialID(credentialID []byte) (Passkey, error) {
+	passkey, err := scanPasskey(s.db.QueryRow("SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE credential_id = $1", credentialID))
+	if err == sql.ErrNoRows {
+		return Passkey{}, ErrPasskeyNotFound
+	}
+	if err != nil {
+		return Passkey{}, fmt.Errorf("error getting passkey: %w", err)
+	}
+	return passkey, nil
+}
+
+func (s *postgresStore) UpdatePasskeyUsage(id int, signCount uint32, backupState bool) error {
+	result, err := s.db.Exec("UPDATE webauthn_credentials SET sign_count = $1, backup_state = $2, last_used_at = now() WHERE id = $3",
+		int64(signCount), backupState, id)
+	if err != nil {
+		return fmt.Errorf("error updating passkey: %w", err)
+	}
+	return expectOneRow(result, ErrPasskeyNotFound)
+}
+
+func (s *postgresStore) RenamePasskey(userID, id int, name string) error {
+	result, err := s.db.Exec("UPDATE webauthn_credentials SET name = $1 WHERE id = $2 AND user_id = $3", name, id, userID)
+	if err != nil {
+		return fmt.Errorf("error renaming passkey: %w", err)
+	}
+	return expectOneRow(result, ErrPasskeyNotFound)
+}
+
+func (s *postgresStore) DeletePasskey(userID, id int) error {
+	result, err := s.db.Exec("DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting passkey: %w", err)
+	}
+	return expectOneRow(result, ErrPasskeyNotFound)
+}
+
+// loginDelaySeconds converts a delay schedule for the float8[] parameter of
+// the throttle queries.
+func loginDelaySeconds(delays []time.Duration) interface{} {
+	seconds := make([]float64, len(delays))
+	for i, delay := range delays {
+		seconds[i] = delay.Seconds()
+	}
+	return pq.Array(seconds)
+}
+
+func (s *postgresStore) ReserveLoginAttempt(scope, subject string, window time.Duration, delays []time.Duration) (LoginThrottle, bool, error) {
+	now := time.Now()
+	throttle := LoginThrottle{Scope: scope, Subject: subject}
+	var lockedUntil sql.NullTime
+	// The lock check, the count and the new lock are one statement, so two
+	// attempts can't both see the scope unlocked and be counted as the
+	// same failure
+	err := s.db.QueryRow(`INSERT INTO login_failures (scope, subject, failures, last_failure_at, locked_until)
+		VALUES ($1, $2, 1, $3, $3::timestamp + make_interval(secs => ($5::float8[])[1]))
+		ON CONFLICT (scope, subject) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $4 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			locked_until = EXCLUDED.last_failure_at + make_interval(secs => ($5::float8[])[LEAST(
+				CASE WHEN login_failures.last_failure_at < $4 THEN 1 ELSE login_failures.failures + 1 END,
+				array_length($5::float8[], 1))])
+		WHERE login_failures.locked_until IS NULL OR login_failures.locked_until <= EXCLUDED.last_failure_at
+		RETURNING failures, last_failure_at, locked_until`,
+		scope, subject, now, now.Add(-window), loginDelaySeconds(delays)).Scan(&throttle.Failures, &throttle.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		throttle, err = s.GetLoginThrottle(scope, subject)
+		return throttle, false, err
+	}
+	if err != nil {
+		return LoginThrottle{}, false, fmt.Errorf("error reserving login attempt: %w", err)
 	}
+	throttle.LockedUntil = lockedUntil.Time
+	return throttle, true, nil
+}
+
+func (s *postgresStore) ReleaseLoginAttempt(scope, subject string, delays []time.Duration) error {
+	_, err := s.db.Exec(`UPDATE login_failures SET
+			failures = failures - 1,
+			locked_until = CASE WHEN failures > 1
+				THEN last_failure_at + make_interval(secs => ($3::float8[])[LEAST(failures - 1, array_length($3::float8[], 1))])
+				END
+		WHERE scope = $1 AND subject = $2 AND failures > 0`,
+		scope, subject, loginDelaySeconds(delays))
+	if err != nil {
+		return fmt.Errorf("error releasing login attempt: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetLoginThrottle(scope, subject string) (LoginThrottle, error) {
+	throttle := LoginThrottle{Scope: scope, Subject: subject}
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_failures WHERE scope = $1 AND subject = $2",
+		scope, subject).Scan(&throttle.Failures, &throttle.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return throttle, nil
+	}
+	if err != nil {
+		return LoginThrottle{}, fmt.Errorf("error getting login failures: %w", err)
+	}
+	throttle.LockedUntil = lockedUntil.Time
+	return throttle, nil
+}
+
+func (s *postgresStore) ClearLoginFailures(scope, subject string) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE scope = $1 AND subject = $2", scope, subject)
+	if err != nil {
+		return fmt.Errorf("error clearing login failures: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) RecordAuditEvent(event *AuditEvent) error {
+	var userID sql.NullInt64
+	if event.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(event.UserID), Valid: true}
+	}
+	err := s.db.QueryRow("INSERT INTO audit_events (event_type, user_id, actor, ip_address, details) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		event.Type, userID, event.Actor, event.IPAddress, event.Details).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error recording audit event: %w", err)
+	}
+	return nil
+}
 
-	return users, nil
+// expectOneRow returns notFound when result affected no rows.
+func expectOneRow(result sql.Result, notFound error) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return notFound
+	}
+	return nil
 }
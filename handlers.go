@@ -2,14 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/gorilla/sessions"
+	"html/template"
 	"log"
 	"net/http"
-	"html/template"
-	"github.com/gorilla/sessions"
+	"net/mail"
+	"path/filepath"
+	"strings"
 )
 
+// Both stores are set up by initSessionStores with the configured keys.
 var (
-	store = sessions.NewCookieStore([]byte("secret-key"))
+	// store keeps browser sessions server-side (see sessions.go).
+	store *serverSessionStore
+	// cookieStore keeps short-lived state from before sign-in, like the
+	// OAuth flow, entirely in signed cookies.
+	cookieStore *sessions.CookieStore
 )
 
 func signupHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,9 +37,22 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Received signup request for user: %s\n", user.Username)
 
-	if user.Username == "" || user.Password == "" {
-		log.Println("Invalid input: username or password is empty")
-		http.Error(w, "Username and password are required", http.StatusBadRequest)
+	var fieldErrors []FieldError
+	if user.Username == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Code: "required", Message: "Username is required"})
+	} else if strings.Contains(user.Username, "@") {
+		// Sign-in and password reset take a username or an email address
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Code: "invalid", Message: "Username can't contain @"})
+	}
+	if user.Email == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Code: "required", Message: "Email is required"})
+	} else if address, err := mail.ParseAddress(user.Email); err != nil || address.Address != user.Email {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Code: "invalid", Message: "Invalid email address"})
+	}
+	fieldErrors = append(fieldErrors, checkPasswordPolicy(user.Password, user.Username, user.Email)...)
+	if len(fieldErrors) > 0 {
+		log.Printf("Rejected signup for user %s: %d invalid fields", user.Username, len(fieldErrors))
+		writeFieldErrors(w, fieldErrors)
 		return
 	}
 
@@ -45,7 +66,13 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	membershipID := generateMembershipID()
 	log.Printf("Generated membership ID: %s\n", membershipID)
 
-	err = createUser(membershipID, user.Username, hashedPassword)
+	newUser := User{MembershipID: membershipID, Username: user.Username, Email: user.Email, Password: hashedPassword}
+	err = userStore.CreateUser(&newUser)
+	if err == ErrUserExists {
+		log.Printf("Username or email already taken: %s\n", user.Username)
+		http.Error(w, "Username or email already taken", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating user: %v\n", err)
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
@@ -53,9 +80,17 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("User created successfully")
+
+	// The mail is queued, so this doesn't wait on the mail server. If
+	// queueing fails the user can ask for another link.
+	err = sendVerificationEmail(newUser)
+	if err != nil {
+		log.Printf("Error sending verification email: %v\n", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message":       "User created successfully",
+		"message":       "User created successfully. Check your email to verify your address.",
 		"membership_id": membershipID,
 	})
 }
@@ -66,16 +101,7 @@ func serveIndexPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFiles("templates/index.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.Execute(w, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	renderPage(w, r, "templates/index.html", nil)
 }
 
 func signinHandler(w http.ResponseWriter, r *http.Request) {
@@ -91,38 +117,117 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getUser(credentials.Username)
+	user, err := userStore.GetUser(credentials.Username)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		if checkLoginAllowed(w, r, nil) {
+			recordLoginFailure(r, nil)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		}
 		return
 	}
 
-	if !checkPasswordHash(credentials.Password, user.Password) {
+	if !checkLoginAllowed(w, r, &user) {
+		return
+	}
+	if user.Password == "" {
+		http.Error(w, noPasswordMessage, http.StatusForbidden)
+		return
+	}
+	ok, needsRehash := verifyPassword(credentials.Password, user.Password)
+	if !ok {
+		recordLoginFailure(r, &user)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if clearGeneratedPassword(r, user, credentials.Password) {
+		http.Error(w, noPasswordMessage, http.StatusForbidden)
+		return
+	}
+	// With two-factor authentication the sign-in only succeeds once the
+	// code is accepted; until then failed codes keep counting against the
+	// account
+	if user.TwoFactorEnabled {
+		releaseLoginAttempt(r, &user)
+	} else {
+		recordLoginSuccess(r, user)
+	}
+	if needsRehash {
+		upgradePasswordHash(user, credentials.Password)
+	}
 
-	// Create a session for the user
-	session, _ := store.Get(r, "session-name")
-	session.Values["user_id"] = user.MembershipID
-	session.Values["username"] = user.Username
-	err = session.Save(r, w)
+	if accountSuspended(user) {
+		log.Printf("Refusing sign-in of suspended user %s", user.Username)
+		http.Error(w, suspendedMessage, http.StatusForbidden)
+		return
+	}
+	if !canSignIn(user) {
+		http.Error(w, "Please verify your email address before signing in", http.StatusForbidden)
+		return
+	}
+
+	needsSecondFactor, err := beginSignIn(w, r, user, "/welcome", credentials.RememberMe)
 	if err != nil {
 		http.Error(w, "Error creating session", http.StatusInternalServerError)
 		return
 	}
+	if needsSecondFactor {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"two_factor_required": true,
+			"redirect":            "/signin/2fa",
+		})
+		return
+	}
 
 	// Redirect to the welcome page
 	http.Redirect(w, r, "/welcome", http.StatusSeeOther)
 }
 
+// startSession signs user in on a new browser session, in place of the
+// current one. Nothing is kept from before: callers read what they need of
+// it (like the 2FA return URL) first.
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	session, err := regenerateSession(r)
+	if err != nil {
+		return err
+	}
+	session.Values["user_id"] = user.MembershipID
+	session.Values["username"] = user.Username
+	session.Values["session_epoch"] = user.SessionEpoch
+	session.Values[sessionUserIDKey] = user.ID
+	return session.Save(r, w)
+}
+
+// currentUser returns the signed-in user, or ErrUserNotFound when the
+// request has no valid session. Sessions started before the user's sessions
+// were invalidated (e.g. by a password reset), and those of suspended users,
+// are no longer valid.
+func currentUser(r *http.Request) (User, error) {
+	session, _ := store.Get(r, sessionCookieName)
+	membershipID, _ := session.Values["user_id"].(string)
+	if membershipID == "" {
+		return User{}, ErrUserNotFound
+	}
+
+	user, err := userStore.GetUserByMembershipID(membershipID)
+	if err != nil {
+		return User{}, err
+	}
+	epoch, _ := session.Values["session_epoch"].(int)
+	if epoch != user.SessionEpoch || accountSuspended(user) {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
 func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	users, err := getAllUsers()
+	users, err := userStore.ListUsers()
 	if err != nil {
 		http.Error(w, "Error retrieving users", http.StatusInternalServerError)
 		return
@@ -134,30 +239,62 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func welcomeHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session-name")
-	username, _ := session.Values["username"].(string)
-
-	tmpl, err := template.ParseFiles("templates/welcome.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	user, err := currentUser(r)
+	signedIn := err == nil
 
 	data := struct {
-		Username string
+		Username    string
+		Email       string
+		Unverified  bool
+		HasPassword bool
+		Expired     bool
+		Providers   []*oauthProvider
 	}{
-		Username: username,
+		Expired:   r.URL.Query().Get("expired") != "",
+		Providers: enabledProviders(),
 	}
-
-	err = tmpl.Execute(w, data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if signedIn {
+		data.Username = user.Username
+		data.Email = user.Email
+		data.Unverified = user.Email != "" && !emailVerified(user)
+		data.HasPassword = user.Password != ""
 	}
+	renderPage(w, r, "templates/welcome.html", data)
 }
 
+// logoutHandler signs the browser out. It only accepts POST, with a CSRF
+// token, so another site can't sign users out.
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session-name")
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	forgetSignIn(w, r)
+	session, _ := store.Get(r, sessionCookieName)
 	session.Options.MaxAge = -1
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// renderPage renders the html template at page with data. The template can
+// use {{csrfToken}}.
+func renderPage(w http.ResponseWriter, r *http.Request, page string, data interface{}) {
+	funcs, err := csrfTemplateFuncs(w, r)
+	if err != nil {
+		log.Printf("Error creating CSRF token: %v", err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New(filepath.Base(page)).Funcs(funcs).ParseFiles(page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
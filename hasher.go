@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordVerifier checks passwords against stored hashes of one algorithm.
+// Hashes are stored as self-describing strings (PHC string format, bcrypt's
+// own $2a$ format, or the legacy formats in legacyhash.go) so the algorithm
+// and parameters of each stored hash are known.
+type PasswordVerifier interface {
+	// Name is the algorithm identifier, as in PASSWORD_HASH_ALGORITHM.
+	Name() string
+	// Identifies reports whether encoded was produced by this algorithm.
+	Identifies(encoded string) bool
+	// Verify reports whether password matches encoded.
+	Verify(password, encoded string) (bool, error)
+}
+
+// PasswordHasher is a PasswordVerifier that new hashes can be made with.
+// Verifiers that aren't hashers are legacy algorithms, kept only so
+// imported accounts can sign in and be rehashed.
+type PasswordHasher interface {
+	PasswordVerifier
+	// Hash returns the encoded hash of password with the current
+	// parameters.
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether encoded was produced with parameters
+	// other than the current ones.
+	NeedsRehash(encoded string) bool
+}
+
+var (
+	// passwordVerifiers are the algorithms stored hashes can be verified
+	// with; passwordHasher is the one new hashes are made with.
+	passwordVerifiers []PasswordVerifier
+	passwordHasher    PasswordHasher
+)
+
+// initPasswordHasher configures password hashing from the environment:
+//
+//	PASSWORD_HASH_ALGORITHM  argon2id (default) or bcrypt
+//	ARGON2_MEMORY            argon2id memory in KiB (default 65536)
+//	ARGON2_ITERATIONS        argon2id passes (default 3)
+//	ARGON2_PARALLELISM       argon2id lanes (default 2)
+//	BCRYPT_COST              bcrypt cost (default 12)
+func initPasswordHasher() error {
+	argon := &argon2idHasher{memory: 64 * 1024, iterations: 3, parallelism: 2, saltLength: 16, keyLength: 32}
+	bc := &bcryptHasher{cost: 12}
+
+	for _, setting := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"ARGON2_MEMORY", &argon.memory, 8 * 1024, 4 * 1024 * 1024},
+		{"ARGON2_ITERATIONS", &argon.iterations, 1, 100},
+		{"ARGON2_PARALLELISM", &argon.parallelism, 1, 255},
+		{"BCRYPT_COST", &bc.cost, bcrypt.MinCost, bcrypt.MaxCost},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < setting.min || n > setting.max {
+				return fmt.Errorf("invalid %s: %s (must be %d-%d)", setting.name, value, setting.min, setting.max)
+			}
+			*setting.value = n
+		}
+	}
+
+	passwordVerifiers = []PasswordVerifier{argon, bc, &pbkdf2SHA256Verifier{}, &saltedSHA1Verifier{}}
+
+	algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM")
+	if algorithm == "" {
+		algorithm = argon.Name()
+	}
+	passwordHasher = nil
+	for _, hasher := range []PasswordHasher{argon, bc} {
+		if hasher.Name() == algorithm {
+			passwordHasher = hasher
+		}
+	}
+	if passwordHasher == nil {
+		return fmt.Errorf("unknown PASSWORD_HASH_ALGORITHM: %s", algorithm)
+	}
+
+	switch h := passwordHasher.(type) {
+	case *argon2idHasher:
+		log.Printf("Hashing passwords with argon2id (m=%d KiB, t=%d, p=%d)", h.memory, h.iterations, h.parallelism)
+	case *bcryptHasher:
+		log.Printf("Hashing passwords with bcrypt (cost %d)", h.cost)
+	}
+	return nil
+}
+
+// findVerifier returns the verifier that identifies encoded, or nil.
+func findVerifier(encoded string) PasswordVerifier {
+	for _, verifier := range passwordVerifiers {
+		if verifier.Identifies(encoded) {
+			return verifier
+		}
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// verifyPassword checks password against the stored hash encoded. If it
+// matches, needsRehash reports whether the hash should be replaced because
+// it uses another algorithm or older parameters than the current hasher.
+func verifyPassword(password, encoded string) (ok, needsRehash bool) {
+	verifier := findVerifier(encoded)
+	if verifier == nil {
+		return false, false
+	}
+
+	ok, err := verifier.Verify(password, encoded)
+	if err != nil {
+		log.Printf("Error verifying %s password hash: %v", verifier.Name(), err)
+		return false, false
+	}
+	if !ok {
+		return false, false
+	}
+	return true, isOutdatedHash(verifier, encoded)
+}
+
+// isOutdatedHash reports whether encoded, identified by verifier, was made
+// with another algorithm or other parameters than the current hasher.
+func isOutdatedHash(verifier PasswordVerifier, encoded string) bool {
+	return verifier != PasswordVerifier(passwordHasher) || passwordHasher.NeedsRehash(encoded)
+}
+
+// upgradePasswordHash replaces user's stored hash with one from the
+// current hasher, after verifyPassword accepted password and asked for a
+// rehash.
+func upgradePasswordHash(user User, password string) {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password for %s: %v", user.Username, err)
+		return
+	}
+	user.Password = hashed
+	err = userStore.UpdateUser(user)
+	if err != nil {
+		log.Printf("Error saving rehashed password for %s: %v", user.Username, err)
+		return
+	}
+	log.Printf("Upgraded password hash of user %s to %s", user.Username, passwordHasher.Name())
+}
+
+// argon2idHasher produces PHC strings like
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>, with unpadded base64.
+type argon2idHasher struct {
+	memory      int
+	iterations  int
+	parallelism int
+	saltLength  int
+	keyLength   int
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h *argon2idHasher) Name() string {
+	return "argon2id"
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("error generating salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, uint32(h.iterations), uint32(h.memory), uint8(h.parallelism), uint32(h.keyLength))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory != uint32(h.memory) || params.iterations != uint32(h.iterations) ||
+		params.parallelism != uint8(h.parallelism) || len(params.salt) != h.saltLength || len(params.key) != h.keyLength
+}
+
+func parseArgon2id(encoded string) (argon2idParams, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return argon2idParams{}, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2idParams{}, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var params argon2idParams
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil || params.iterations < 1 || params.parallelism < 1 {
+		return argon2idParams{}, fmt.Errorf("malformed argon2id parameters %q", parts[3])
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2idParams{}, fmt.Errorf("malformed argon2id salt: %v", err)
+	}
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return argon2idParams{}, fmt.Errorf("malformed argon2id hash value")
+	}
+	return params, nil
+}
+
+// bcryptHasher produces bcrypt's $2a$<cost>$... strings.
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hashed), err
+}
+
+func (h *bcryptHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *bcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// passwordHashReport counts the stored password hashes by algorithm, to
+// show how far the move off legacy and outdated hashes has got.
+type passwordHashReport struct {
+	Total      int            `json:"total"`
+	Algorithms map[string]int `json:"algorithms"`
+	// Legacy counts hashes from verify-only algorithms.
+	Legacy int `json:"legacy"`
+	// Outdated counts hashes that will be rehashed at their next sign-in,
+	// legacy ones included.
+	Outdated     int `json:"outdated"`
+	Unrecognised int `json:"unrecognised"`
+}
+
+func reportPasswordHashes() (passwordHashReport, error) {
+	hashes, err := userStore.ListPasswordHashes()
+	if err != nil {
+		return passwordHashReport{}, fmt.Errorf("error listing password hashes: %v", err)
+	}
+
+	report := passwordHashReport{Total: len(hashes), Algorithms: make(map[string]int)}
+	for _, encoded := range hashes {
+		verifier := findVerifier(encoded)
+		if verifier == nil {
+			report.Unrecognised++
+			continue
+		}
+		report.Algorithms[verifier.Name()]++
+		if _, ok := verifier.(PasswordHasher); !ok {
+			report.Legacy++
+		}
+		if isOutdatedHash(verifier, encoded) {
+			report.Outdated++
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// useTestHasher makes hashing fast for tests: argon2id at its minimum
+// memory and one pass, and bcrypt at its minimum cost.
+func useTestHasher(t *testing.T, algorithm string) {
+	t.Helper()
+	t.Setenv("PASSWORD_HASH_ALGORITHM", algorithm)
+	t.Setenv("ARGON2_MEMORY", "8192")
+	t.Setenv("ARGON2_ITERATIONS", "1")
+	t.Setenv("BCRYPT_COST", "4")
+	if err := initPasswordHasher(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for _, algorithm := range []string{"argon2id", "bcrypt"} {
+		t.Run(algorithm, func(t *testing.T) {
+			useTestHasher(t, algorithm)
+			encoded, err := hashPassword("Correct-Horse-77")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if passwordHasher.Name() != algorithm || !passwordHasher.Identifies(encoded) {
+				t.Fatalf("%s hasher made %s", passwordHasher.Name(), encoded)
+			}
+
+			if ok, rehash := verifyPassword("Correct-Horse-77", encoded); !ok || rehash {
+				t.Fatalf("right password: got ok %v, rehash %v", ok, rehash)
+			}
+			if ok, _ := verifyPassword("correct-horse-77", encoded); ok {
+				t.Fatal("wrong password accepted")
+			}
+			if again, _ := hashPassword("Correct-Horse-77"); again == encoded {
+				t.Fatal("two hashes of the same password are equal; salt missing")
+			}
+		})
+	}
+}
+
+func TestPasswordHashNeedsRehash(t *testing.T) {
+	useTestHasher(t, "bcrypt")
+	bcryptHash, _ := hashPassword("Correct-Horse-77")
+	t.Setenv("BCRYPT_COST", "5")
+	initPasswordHasher()
+	bcryptCost5, _ := hashPassword("Correct-Horse-77")
+
+	useTestHasher(t, "argon2id")
+	argonHash, _ := hashPassword("Correct-Horse-77")
+	t.Setenv("ARGON2_ITERATIONS", "2")
+	initPasswordHasher()
+	argonTwoPasses, _ := hashPassword("Correct-Horse-77")
+	useTestHasher(t, "argon2id")
+
+	for _, test := range []struct {
+		name    string
+		encoded string
+		rehash  bool
+	}{
+		{"current argon2id", argonHash, false},
+		{"argon2id with other parameters", argonTwoPasses, true},
+		{"bcrypt", bcryptHash, true},
+		{"bcrypt with another cost", bcryptCost5, true},
+	} {
+		ok, rehash := verifyPassword("Correct-Horse-77", test.encoded)
+		if !ok || rehash != test.rehash {
+			t.Errorf("%s: got ok %v, rehash %v; want rehash %v", test.name, ok, rehash, test.rehash)
+		}
+	}
+
+	// With bcrypt configured, argon2id hashes still verify, and get replaced
+	useTestHasher(t, "bcrypt")
+	if ok, rehash := verifyPassword("Correct-Horse-77", argonHash); !ok || !rehash {
+		t.Fatalf("argon2id under bcrypt: got ok %v, rehash %v", ok, rehash)
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, test := range []struct {
+		name    string
+		encoded string
+		ok      bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key, true},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key, false},
+		{"argon2i", "$argon2i$v=19$m=65536,t=3,p=2$" + salt + "$" + key, false},
+		{"missing part", "$argon2id$v=19$m=65536,t=3,p=2$" + key, false},
+		{"extra part", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key + "$x", false},
+		{"malformed parameters", "$argon2id$v=19$m=65536;t=3;p=2$" + salt + "$" + key, false},
+		{"zero passes", "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key, false},
+		{"zero lanes", "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, false},
+		{"padded salt", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "==$" + key, false},
+		{"empty hash", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$", false},
+	} {
+		params, err := parseArgon2id(test.encoded)
+		if test.ok && (err != nil || params.memory != 65536 || params.iterations != 3 || params.parallelism != 2) {
+			t.Errorf("%s: got %+v, err %v", test.name, params, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: parsed %q", test.name, test.encoded)
+		}
+	}
+
+	useTestHasher(t, "argon2id")
+	if ok, _ := verifyPassword("anything", "$argon2id$v=19$m=65536,t=3,p=2$"+salt+"$"); ok {
+		t.Fatal("malformed hash accepted")
+	}
+	if ok, _ := verifyPassword("anything", "plaintext"); ok {
+		t.Fatal("unrecognised hash accepted")
+	}
+}
+
+func TestSignInRehashesPassword(t *testing.T) {
+	setupTestServer(t)
+	useTestHasher(t, "bcrypt")
+	user := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	useTestHasher(t, "argon2id")
+
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"wrong-password"}`)
+	if w.Code == http.StatusSeeOther {
+		t.Fatal("sign-in with a wrong password succeeded")
+	}
+	if stored, _ := userStore.GetUser("alice"); stored.Password != user.Password {
+		t.Fatal("a failed sign-in replaced the hash")
+	}
+
+	w = serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"Correct-Horse-77-battery"}`)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("sign-in: got %d %s", w.Code, w.Body)
+	}
+	stored, _ := userStore.GetUser("alice")
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Fatalf("hash not upgraded: %s", stored.Password)
+	}
+	if ok, rehash := verifyPassword("Correct-Horse-77-battery", stored.Password); !ok || rehash {
+		t.Fatalf("upgraded hash: got ok %v, rehash %v", ok, rehash)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// runImportUsersCommand implements "import-users [-dry-run] <file.csv>",
+// which creates accounts migrated from another system. The CSV file needs a
+// header row naming its columns:
+//
+//	username        required
+//	password_hash   required, stored verbatim; any format passwordVerifiers
+//	                recognises (argon2id, bcrypt, pbkdf2-sha256, sha1)
+//	email           optional
+//	email_verified  optional, true if the old system had verified the email
+//
+// Rows that are invalid, including fields too long for their columns, or
+// whose username or email is already taken, are logged and skipped; the rest
+// are imported. Imported rows aren't logged one by one. With -dry-run nothing
+// is written.
+func runImportUsersCommand(args []string) error {
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "check the file without importing anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-users [-dry-run] <file.csv>")
+	}
+
+	err = initPasswordHasher()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening import file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading import file header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"username", "password_hash"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("import file has no %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	if !*dryRun {
+		err = initStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+	}
+
+	var imported, skipped int
+	algorithms := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Skipping record: %v", err)
+			skipped++
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		user, err := importedUser(field(record, "username"), field(record, "email"),
+			field(record, "password_hash"), field(record, "email_verified"))
+		if err != nil {
+			log.Printf("Line %d: %v", line, err)
+			skipped++
+			continue
+		}
+		algorithm := findVerifier(user.Password).Name()
+
+		if !*dryRun {
+			err = userStore.CreateUser(&user)
+			if err == ErrUserExists {
+				log.Printf("Line %d: username or email of %s already taken", line, user.Username)
+				skipped++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error importing line %d: %v", line, err)
+			}
+		}
+
+		imported++
+		algorithms[algorithm]++
+		if imported%1000 == 0 {
+			log.Printf("Imported %d users so far", imported)
+		}
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d users, skipped %d\n", verb, imported, skipped)
+	for _, verifier := range passwordVerifiers {
+		if n := algorithms[verifier.Name()]; n > 0 {
+			fmt.Printf("  %-14s %d\n", verifier.Name(), n)
+		}
+	}
+	return nil
+}
+
+// Sizes of the users columns (see migrations/0001 and 0002). Longer values
+// are rejected by the database.
+const (
+	maxUsernameLength = 50
+	maxEmailLength    = 255
+)
+
+// importedUser validates one row of an import file and returns the user to
+// create.
+func importedUser(username, email, passwordHash, emailVerified string) (User, error) {
+	for _, value := range []string{username, email, passwordHash} {
+		if !utf8.ValidString(value) || strings.ContainsRune(value, 0) {
+			return User{}, fmt.Errorf("row has invalid UTF-8 or a NUL character")
+		}
+	}
+	if username == "" {
+		return User{}, fmt.Errorf("username is empty")
+	}
+	if strings.Contains(username, "@") {
+		// As at signup: sign-in and password reset take a username or an
+		// email address
+		return User{}, fmt.Errorf("username %s contains @", username)
+	}
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return User{}, fmt.Errorf("username %s is longer than %d characters", username, maxUsernameLength)
+	}
+	if findVerifier(passwordHash) == nil {
+		return User{}, fmt.Errorf("password hash of %s is in an unrecognised format", username)
+	}
+
+	user := User{
+		MembershipID: generateMembershipID(),
+		Username:     username,
+		Password:     passwordHash,
+	}
+
+	if email != "" {
+		if utf8.RuneCountInString(email) > maxEmailLength {
+			return User{}, fmt.Errorf("email address of %s is longer than %d characters", username, maxEmailLength)
+		}
+		address, err := mail.ParseAddress(email)
+		if err != nil || address.Address != email {
+			return User{}, fmt.Errorf("invalid email address for %s: %s", username, email)
+		}
+		user.Email = email
+	}
+
+	if emailVerified != "" {
+		verified, err := strconv.ParseBool(emailVerified)
+		if err != nil {
+			return User{}, fmt.Errorf("invalid email_verified for %s: %s", username, emailVerified)
+		}
+		if verified && user.Email != "" {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportedUser(t *testing.T) {
+	useTestHasher(t, "argon2id")
+
+	for _, test := range []struct {
+		name                                    string
+		username, email, passwordHash, verified string
+		ok, emailVerified                       bool
+	}{
+		{name: "minimal", username: "alice", passwordHash: saltedSHA1Hash, ok: true},
+		{name: "verified email", username: "alice", email: "alice@example.com", passwordHash: djangoPBKDF2Hash, verified: "true", ok: true, emailVerified: true},
+		{name: "unverified email", username: "alice", email: "alice@example.com", passwordHash: djangoPBKDF2Hash, verified: "false", ok: true},
+		{name: "verified without email", username: "alice", passwordHash: djangoPBKDF2Hash, verified: "true", ok: true},
+		{name: "no username", passwordHash: saltedSHA1Hash},
+		{name: "username with @", username: "alice@example.com", email: "alice@example.com", passwordHash: saltedSHA1Hash},
+		{name: "unknown hash format", username: "alice", passwordHash: "md5$x$0123"},
+		{name: "plaintext password", username: "alice", passwordHash: "Correct-Horse-77"},
+		{name: "invalid email", username: "alice", email: "alice at example.com", passwordHash: saltedSHA1Hash},
+		{name: "email with display name", username: "alice", email: "Alice <alice@example.com>", passwordHash: saltedSHA1Hash},
+		{name: "invalid verified flag", username: "alice", email: "alice@example.com", passwordHash: saltedSHA1Hash, verified: "yes please"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := importedUser(test.username, test.email, test.passwordHash, test.verified)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("accepted %+v", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Username != test.username || user.Email != test.email || user.Password != test.passwordHash || user.MembershipID == "" {
+				t.Fatalf("got %+v", user)
+			}
+			if (user.EmailVerifiedAt != nil) != test.emailVerified {
+				t.Fatalf("got email verified at %v, want verified %v", user.EmailVerifiedAt, test.emailVerified)
+			}
+		})
+	}
+}
+
+func TestImportUsersCommand(t *testing.T) {
+	setupTestServer(t)
+	useTestHasher(t, "argon2id")
+	file := filepath.Join(t.TempDir(), "accounts.csv")
+	rows := []string{
+		"Username,Email,Password_Hash,Email_Verified",
+		"alice,alice@example.com," + djangoPBKDF2Hash + ",true",
+		"bob,," + passlibPBKDF2Hash + ",",
+		"carol,carol@example.com," + saltedSHA1Hash + ",false",
+		"alice,other@example.com," + saltedSHA1Hash + ",",
+		"dave,alice@example.com," + saltedSHA1Hash + ",",
+		"erin,,plaintext,",
+		"frank@example.com,frank@example.com," + saltedSHA1Hash + ",",
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(rows, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run writes nothing
+	userStore = newMemoryStore()
+	if err := runImportUsersCommand([]string{"-dry-run", file}); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := userStore.ListUsers(); len(users) != 0 {
+		t.Fatalf("dry run imported %d users", len(users))
+	}
+
+	if err := runImportUsersCommand([]string{file}); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := userStore.ListUsers()
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	if strings.Join(names, ",") != "alice,bob,carol" {
+		t.Fatalf("imported %v, want alice, bob and carol", names)
+	}
+	alice, _ := userStore.GetUser("alice")
+	if alice.Email != "alice@example.com" || alice.EmailVerifiedAt == nil || alice.Password != djangoPBKDF2Hash {
+		t.Fatalf("alice imported as %+v", alice)
+	}
+
+	// Signing in with the imported hash replaces it with the current one
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"Correct-Horse-77"}`)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("sign-in: got %d %s", w.Code, w.Body)
+	}
+	if alice, _ = userStore.GetUser("alice"); !strings.HasPrefix(alice.Password, "$argon2id$") {
+		t.Fatalf("imported hash not upgraded: %s", alice.Password)
+	}
+
+	if err := runImportUsersCommand([]string{file, "extra"}); err == nil {
+		t.Fatal("accepted two files")
+	}
+	if err := runImportUsersCommand([]string{filepath.Join(t.TempDir(), "missing.csv")}); err == nil {
+		t.Fatal("accepted a missing file")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The verifiers in this file accept hashes imported from older systems.
+// They can't make new hashes: an account using one is rehashed with the
+// current algorithm the first time its password is verified.
+//
+// Identifies parses the whole hash, not just the prefix, so that
+// import-users rejects malformed hashes instead of storing ones that can
+// never match.
+
+// pbkdf2SHA256Verifier accepts PBKDF2-HMAC-SHA256 hashes in Django's format,
+//
+//	pbkdf2_sha256$<iterations>$<salt>$<base64 key>
+//
+// where the salt is used as-is, and in passlib's modular crypt format,
+//
+//	$pbkdf2-sha256$<iterations>$<salt>$<key>
+//
+// where salt and key are unpadded base64 with "." in place of "+".
+type pbkdf2SHA256Verifier struct{}
+
+type pbkdf2Params struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+func (v *pbkdf2SHA256Verifier) Name() string {
+	return "pbkdf2-sha256"
+}
+
+func (v *pbkdf2SHA256Verifier) Identifies(encoded string) bool {
+	_, err := parsePBKDF2SHA256(encoded)
+	return err == nil
+}
+
+func (v *pbkdf2SHA256Verifier) Verify(password, encoded string) (bool, error) {
+	params, err := parsePBKDF2SHA256(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := pbkdf2.Key([]byte(password), params.salt, params.iterations, len(params.key), sha256.New)
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func parsePBKDF2SHA256(encoded string) (pbkdf2Params, error) {
+	var params pbkdf2Params
+	var iterations, salt, key string
+	var err error
+
+	parts := strings.Split(encoded, "$")
+	switch {
+	case len(parts) == 4 && parts[0] == "pbkdf2_sha256":
+		iterations, salt, key = parts[1], parts[2], parts[3]
+		params.salt = []byte(salt)
+		params.key, err = base64.StdEncoding.DecodeString(key)
+	case len(parts) == 5 && parts[0] == "" && parts[1] == "pbkdf2-sha256":
+		iterations, salt, key = parts[2], parts[3], parts[4]
+		params.salt, err = decodePasslibBase64(salt)
+		if err == nil {
+			params.key, err = decodePasslibBase64(key)
+		}
+	default:
+		return pbkdf2Params{}, fmt.Errorf("malformed pbkdf2-sha256 hash")
+	}
+	if err != nil || len(params.key) == 0 {
+		return pbkdf2Params{}, fmt.Errorf("malformed pbkdf2-sha256 hash value")
+	}
+
+	params.iterations, err = strconv.Atoi(iterations)
+	if err != nil || params.iterations < 1 {
+		return pbkdf2Params{}, fmt.Errorf("malformed pbkdf2-sha256 iterations %q", iterations)
+	}
+	if len(params.salt) == 0 {
+		return pbkdf2Params{}, fmt.Errorf("malformed pbkdf2-sha256 salt")
+	}
+	return params, nil
+}
+
+// decodePasslibBase64 decodes passlib's "adapted base64".
+func decodePasslibBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s, ".", "+"))
+}
+
+// saltedSHA1Verifier accepts salted SHA-1 hashes in Django's format,
+//
+//	sha1$<salt>$<hex of sha1(salt + password)>
+type saltedSHA1Verifier struct{}
+
+func (v *saltedSHA1Verifier) Name() string {
+	return "sha1"
+}
+
+func (v *saltedSHA1Verifier) Identifies(encoded string) bool {
+	_, _, err := parseSaltedSHA1(encoded)
+	return err == nil
+}
+
+func (v *saltedSHA1Verifier) Verify(password, encoded string) (bool, error) {
+	salt, digest, err := parseSaltedSHA1(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha1.Sum([]byte(salt + password))
+	return subtle.ConstantTimeCompare(sum[:], digest) == 1, nil
+}
+
+func parseSaltedSHA1(encoded string) (string, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 || parts[0] != "sha1" || parts[1] == "" {
+		return "", nil, fmt.Errorf("malformed sha1 hash")
+	}
+
+	digest, err := hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha1.Size {
+		return "", nil, fmt.Errorf("malformed sha1 hash value")
+	}
+	return parts[1], digest, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// Hashes of "Correct-Horse-77" made with Python's hashlib.
+const (
+	djangoPBKDF2Hash  = "pbkdf2_sha256$1000$seasalt$vgJP7O1gLKNAoIYCNQ014HC4Ti4qpPlGmaAPUQeOUg8="
+	passlibPBKDF2Hash = "$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$3BiJk78zAfLFsmmm6MeLYLICtiRCthj4Hnjyk.oFcjQ"
+	saltedSHA1Hash    = "sha1$pepper$ceb0ab09d6e804bb4956d07c5f629b0abacdb14c"
+)
+
+func TestLegacyHashes(t *testing.T) {
+	useTestHasher(t, "argon2id")
+
+	for _, test := range []struct {
+		name      string
+		encoded   string
+		algorithm string
+	}{
+		{"django pbkdf2", djangoPBKDF2Hash, "pbkdf2-sha256"},
+		{"passlib pbkdf2", passlibPBKDF2Hash, "pbkdf2-sha256"},
+		{"salted sha1", saltedSHA1Hash, "sha1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := findVerifier(test.encoded)
+			if verifier == nil || verifier.Name() != test.algorithm {
+				t.Fatalf("got verifier %v, want %s", verifier, test.algorithm)
+			}
+			// Legacy hashes always ask to be replaced
+			if ok, rehash := verifyPassword("Correct-Horse-77", test.encoded); !ok || !rehash {
+				t.Fatalf("right password: got ok %v, rehash %v", ok, rehash)
+			}
+			if ok, _ := verifyPassword("Correct-Horse-78", test.encoded); ok {
+				t.Fatal("wrong password accepted")
+			}
+		})
+	}
+}
+
+func TestLegacyHashesMalformed(t *testing.T) {
+	useTestHasher(t, "argon2id")
+
+	for _, encoded := range []string{
+		"pbkdf2_sha256$1000$seasalt$",
+		"pbkdf2_sha256$0$seasalt$vgJP7O1gLKNAoIYCNQ014HC4Ti4qpPlGmaAPUQeOUg8=",
+		"pbkdf2_sha256$many$seasalt$vgJP7O1gLKNAoIYCNQ014HC4Ti4qpPlGmaAPUQeOUg8=",
+		"pbkdf2_sha256$1000$$vgJP7O1gLKNAoIYCNQ014HC4Ti4qpPlGmaAPUQeOUg8=",
+		"pbkdf2_sha256$1000$seasalt$not base64",
+		"pbkdf2_sha1$1000$seasalt$vgJP7O1gLKNAoIYCNQ014HC4Ti4qpPlGmaAPUQeOUg8=",
+		"$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg",
+		"$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg==$3BiJk78zAfLFsmmm6MeLYLICtiRCthj4Hnjyk.oFcjQ",
+		"sha1$$ceb0ab09d6e804bb4956d07c5f629b0abacdb14c",
+		"sha1$pepper$ceb0ab09d6e804bb4956d07c5f629b0abacdb1",
+		"sha1$pepper$zzb0ab09d6e804bb4956d07c5f629b0abacdb14c",
+		"md5$pepper$ceb0ab09d6e804bb4956d07c5f629b0a",
+		"Correct-Horse-77",
+	} {
+		if verifier := findVerifier(encoded); verifier != nil {
+			t.Errorf("%s identified as %s", encoded, verifier.Name())
+		}
+		if ok, _ := verifyPassword("Correct-Horse-77", encoded); ok {
+			t.Errorf("%s accepted", encoded)
+		}
+	}
+}
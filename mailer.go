@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email is a message to a single recipient with a plain-text body and an
+// optional HTML alternative.
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers email to users. Implementations may block on the network;
+// application code queues mail with sendEmail and the mail worker calls
+// Send.
+type Mailer interface {
+	Send(email Email) error
+}
+
+var (
+	mailer   Mailer
+	mailFrom string
+)
+
+// initMailer selects the mail backend from MAIL_BACKEND, which must be
+// set:
+//
+//	log   write messages to the application log
+//	file  write .eml files to MAIL_DROP_DIR (default "mail")
+//	smtp  deliver through SMTP_HOST:SMTP_PORT
+//
+// There is no default, because log and file keep live reset and
+// verification links where anyone with access to the log or directory can
+// use them.
+func initMailer() error {
+	mailFrom = os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "no-reply@localhost"
+	}
+	sender, err := mail.ParseAddress(mailFrom)
+	if err != nil {
+		return fmt.Errorf("invalid MAIL_FROM address: %v", err)
+	}
+
+	backend := os.Getenv("MAIL_BACKEND")
+	switch backend {
+	case "":
+		return fmt.Errorf("MAIL_BACKEND must be set: smtp, or log or file for local development")
+	case "log":
+		log.Println("WARNING: using log mailer; emails, with their links, will be written to the log")
+		mailer = logMailer{}
+	case "file":
+		dir := os.Getenv("MAIL_DROP_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		err = os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return fmt.Errorf("error creating mail drop directory: %v", err)
+		}
+		log.Printf("Using file mailer; emails will be written to %s", dir)
+		mailer = &fileMailer{dir: dir, from: mailFrom}
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return fmt.Errorf("SMTP_HOST must be set for the smtp mail backend")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		log.Printf("Using SMTP mailer via %s:%s", host, port)
+		mailer = &smtpMailer{
+			host:     host,
+			port:     port,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     mailFrom,
+			sender:   sender.Address,
+			timeout:  30 * time.Second,
+		}
+	default:
+		return fmt.Errorf("unknown MAIL_BACKEND: %s", backend)
+	}
+	return nil
+}
+
+// logMailer writes messages to the application log instead of sending them.
+// It is meant for local development: the log will contain live links.
+type logMailer struct{}
+
+func (logMailer) Send(email Email) error {
+	log.Printf("Email to %s\nSubject: %s\n\n%s", email.To, email.Subject, email.Text)
+	return nil
+}
+
+// fileMailer writes each message as an .eml file, for local development and
+// tests that need to read what would have been sent.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(email Email) error {
+	message, err := buildMessage(m.from, email)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), generateRandomToken(6))
+	return os.WriteFile(filepath.Join(m.dir, name), message, 0o644)
+}
+
+// smtpMailer delivers through an SMTP relay, upgrading to TLS with STARTTLS
+// when offered. Port 465 uses implicit TLS.
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+	// sender is the bare address of from, used as the envelope sender.
+	sender  string
+	timeout time.Duration
+}
+
+func (m *smtpMailer) Send(email Email) error {
+	message, err := buildMessage(m.from, email)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.host, m.port)
+	tlsConfig := &tls.Config{ServerName: m.host}
+
+	var conn net.Conn
+	if m.port == "465" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: m.timeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, m.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout))
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error starting SMTP session: %v", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+	if m.username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.username, m.password, m.host))
+		if err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %v", err)
+		}
+	}
+
+	err = client.Mail(m.sender)
+	if err != nil {
+		return fmt.Errorf("error sending MAIL FROM: %v", err)
+	}
+	err = client.Rcpt(email.To)
+	if err != nil {
+		return fmt.Errorf("error sending RCPT TO: %v", err)
+	}
+
+	data, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending DATA: %v", err)
+	}
+	_, err = data.Write(message)
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	err = data.Close()
+	if err != nil {
+		return fmt.Errorf("error finishing message: %v", err)
+	}
+
+	return client.Quit()
+}
+
+// buildMessage renders email as an RFC 5322 message. With an HTML body it
+// is multipart/alternative; otherwise plain text.
+func buildMessage(from string, email Email) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+
+	header("From", from)
+	header("To", email.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", generateRandomToken(16), domainOf(from)))
+	header("MIME-Version", "1.0")
+
+	if email.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		err := writeQuotedPrintable(&buf, email.Text)
+		return buf.Bytes(), err
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = writeQuotedPrintable(w, part.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := parts.Close()
+	return buf.Bytes(), err
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	_, err := qp.Write([]byte(body))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func domainOf(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "localhost"
+	}
+	return strings.TrimSuffix(address[at+1:], ">")
+}
+
+// renderEmail builds an email from templates/email/<name>.txt, rendered
+// with text/template, and templates/email/<name>.html, rendered with
+// html/template if it exists. The text template must define a "subject"
+// template for the subject line.
+func renderEmail(name, to string, data interface{}) (Email, error) {
+	email := Email{To: to}
+
+	textTmpl, err := texttemplate.ParseFiles(filepath.Join("templates", "email", name+".txt"))
+	if err != nil {
+		return Email{}, fmt.Errorf("error parsing email template %s: %v", name, err)
+	}
+
+	var subject, text bytes.Buffer
+	err = textTmpl.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return Email{}, fmt.Errorf("error rendering subject of %s: %v", name, err)
+	}
+	err = textTmpl.Execute(&text, data)
+	if err != nil {
+		return Email{}, fmt.Errorf("error rendering email %s: %v", name, err)
+	}
+	email.Subject = strings.TrimSpace(subject.String())
+	email.Text = strings.TrimLeft(text.String(), "\n")
+
+	htmlPath := filepath.Join("templates", "email", name+".html")
+	if _, err := os.Stat(htmlPath); err == nil {
+		htmlTmpl, err := htmltemplate.ParseFiles(htmlPath)
+		if err != nil {
+			return Email{}, fmt.Errorf("error parsing email template %s: %v", htmlPath, err)
+		}
+
+		var html bytes.Buffer
+		err = htmlTmpl.Execute(&html, data)
+		if err != nil {
+			return Email{}, fmt.Errorf("error rendering email %s: %v", htmlPath, err)
+		}
+		email.HTML = html.String()
+	}
+
+	return email, nil
+}
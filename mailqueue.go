@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	mailStatusPending = "pending"
+	mailStatusSent    = "sent"
+	mailStatusFailed  = "failed"
+)
+
+const (
+	// mailWorkerInterval is how often the worker looks for due mail.
+	mailWorkerInterval = 5 * time.Second
+	mailBatchSize      = 10
+	// mailLease is how long a claimed message is hidden from other workers.
+	// A message still unsent after that (e.g. the process died) is retried.
+	mailLease = 5 * time.Minute
+	// mailMaxAttempts is how many deliveries are tried before a message is
+	// marked failed. Retries back off exponentially from mailRetryBase.
+	mailMaxAttempts = 8
+	mailRetryBase   = time.Minute
+	mailRetryMax    = time.Hour
+)
+
+// MailQueue is the persistent outgoing mail queue. Messages are queued by
+// request handlers and delivered by the mail worker, so a slow or broken
+// mail server never holds up a request.
+type MailQueue interface {
+	// EnqueueEmail adds a pending message and fills in its ID.
+	EnqueueEmail(email *QueuedEmail) error
+	// ClaimEmails returns up to limit pending messages that are due,
+	// counting an attempt for each and hiding them from other claims for
+	// lease.
+	ClaimEmails(limit int, lease time.Duration) ([]QueuedEmail, error)
+	// MarkEmailSent marks a message sent and clears its bodies, which may
+	// hold live links (password reset, verification, ...).
+	MarkEmailSent(id int) error
+	// MarkEmailFailed records a failed attempt. The message is retried at
+	// retryAt, or marked failed for good, with its bodies cleared, if
+	// retryAt is zero.
+	MarkEmailFailed(id int, lastError string, retryAt time.Time) error
+}
+
+var mailQueue MailQueue
+
+// sendEmail renders the email template name for to and queues it.
+func sendEmail(name, to string, data interface{}) error {
+	email, err := renderEmail(name, to, data)
+	if err != nil {
+		return err
+	}
+
+	queued := QueuedEmail{Email: email}
+	err = mailQueue.EnqueueEmail(&queued)
+	if err != nil {
+		return fmt.Errorf("error queueing email: %v", err)
+	}
+	log.Printf("Queued %s email %d to %s", name, queued.ID, to)
+	return nil
+}
+
+// runMailWorker delivers queued mail until ctx is cancelled.
+func runMailWorker(ctx context.Context) {
+	log.Println("Mail worker started")
+	ticker := time.NewTicker(mailWorkerInterval)
+	defer ticker.Stop()
+
+	for {
+		processMailQueue()
+
+		select {
+		case <-ctx.Done():
+			log.Println("Mail worker stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processMailQueue delivers one batch of due messages.
+func processMailQueue() {
+	emails, err := mailQueue.ClaimEmails(mailBatchSize, mailLease)
+	if err != nil {
+		log.Printf("Error claiming queued email: %v", err)
+		return
+	}
+
+	for _, queued := range emails {
+		err := mailer.Send(queued.Email)
+		if err == nil {
+			err = mailQueue.MarkEmailSent(queued.ID)
+			if err != nil {
+				log.Printf("Error marking email %d sent: %v", queued.ID, err)
+			}
+			continue
+		}
+
+		var retryAt time.Time
+		if queued.Attempts < mailMaxAttempts {
+			retryAt = time.Now().Add(mailRetryDelay(queued.Attempts))
+			log.Printf("Error sending email %d to %s (attempt %d), retrying at %s: %v", queued.ID, queued.Email.To, queued.Attempts, retryAt.Format(time.RFC3339), err)
+		} else {
+			log.Printf("Error sending email %d to %s, giving up after %d attempts: %v", queued.ID, queued.Email.To, queued.Attempts, err)
+		}
+
+		err = mailQueue.MarkEmailFailed(queued.ID, err.Error(), retryAt)
+		if err != nil {
+			log.Printf("Error recording failed email %d: %v", queued.ID, err)
+		}
+	}
+}
+
+// mailRetryDelay is the wait after the given number of failed attempts.
+func mailRetryDelay(attempts int) time.Duration {
+	delay := mailRetryBase
+	for i := 1; i < attempts && delay < mailRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > mailRetryMax {
+		delay = mailRetryMax
+	}
+	return delay
+}
@@ -24,37 +24,168 @@ func main() {
 		log.Println(".env file loaded successfully")
 	}
 
+	// Run a maintenance command instead of the server if one was given
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrateCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "unlock" {
+		err := runUnlockCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Unlock failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-users" {
+		err := runImportUsersCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		err := runKeygenCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Key generation failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "grant-role" || os.Args[1] == "revoke-role") {
+		err := runRoleCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatalf("Role change failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "password-report" {
+		err := runPasswordReportCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Password report failed: %v", err)
+		}
+		return
+	}
+
 	// Log environment variables
 	log.Printf("GOOGLE_OAUTH_CLIENT_ID: %s", os.Getenv("GOOGLE_OAUTH_CLIENT_ID"))
 	log.Printf("GOOGLE_OAUTH_CLIENT_SECRET: %s", maskString(os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET")))
 	log.Printf("GOOGLE_OAUTH_REDIRECT_URL: %s", os.Getenv("GOOGLE_OAUTH_REDIRECT_URL"))
+	log.Printf("OIDC_PROVIDERS: %s", os.Getenv("OIDC_PROVIDERS"))
+	log.Printf("OIDC_PROVIDERS_FILE: %s", os.Getenv("OIDC_PROVIDERS_FILE"))
 
-	// Check if required environment variables are set
-	if os.Getenv("GOOGLE_OAUTH_CLIENT_ID") == "" || os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET") == "" {
-		log.Fatal("GOOGLE_OAUTH_CLIENT_ID and GOOGLE_OAUTH_CLIENT_SECRET must be set in .env file")
-	} else {
-		log.Println("Required environment variables are set")
+	// Build the OAuth provider registry
+	err = initProviders()
+	if err != nil {
+		log.Fatalf("Error configuring OAuth providers: %v", err)
+	}
+	if len(oauthProviders) == 0 {
+		log.Println("No OAuth providers configured; only password sign-in is available")
+	}
+
+	err = loadUnverifiedLoginPolicy()
+	if err != nil {
+		log.Fatalf("Error configuring email verification: %v", err)
+	}
+
+	err = loadLoginThrottlePolicy()
+	if err != nil {
+		log.Fatalf("Error configuring sign-in throttling: %v", err)
+	}
+
+	err = initPasswordHasher()
+	if err != nil {
+		log.Fatalf("Error configuring password hashing: %v", err)
+	}
+
+	err = loadPasswordPolicy()
+	if err != nil {
+		log.Fatalf("Error configuring password policy: %v", err)
+	}
+
+	err = initWebAuthn()
+	if err != nil {
+		log.Fatalf("Error configuring passkeys: %v", err)
+	}
+
+	err = initSessionStores()
+	if err != nil {
+		log.Fatalf("Error configuring sessions: %v", err)
+	}
+
+	// Initialize the user store (Postgres unless STORE_BACKEND says otherwise)
+	err = initStore()
+	if err != nil {
+		log.Fatalf("Error initializing store: %v", err)
+	}
+	defer closeStore()
+	log.Println("Store initialized successfully")
+
+	err = bootstrapAdmin()
+	if err != nil {
+		log.Fatalf("Error granting INITIAL_ADMIN the admin role: %v", err)
 	}
 
-	// Initialize database connection
-	log.Println("Initializing database connection...")
-	err = initDB()
+	// Set up outgoing email and start delivering the queue
+	err = initMailer()
 	if err != nil {
-		log.Fatalf("Error initializing database: %v", err)
+		log.Fatalf("Error initializing mailer: %v", err)
 	}
-	defer db.Close()
-	log.Println("Database connection initialized successfully")
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go runMailWorker(workerCtx)
+	go runSessionSweeper(workerCtx)
 
 	// Set up routes
 	log.Println("Setting up routes...")
 	http.HandleFunc("/", welcomeHandler)
 	http.HandleFunc("/signup", signupHandler)
 	http.HandleFunc("/signin", signinHandler)
-	http.HandleFunc("/users", getUsersHandler)
-	http.HandleFunc("/auth/google/login", handleGoogleLogin)
-	http.HandleFunc("/auth/google/callback", handleGoogleCallback)
+	http.HandleFunc("/signin/2fa", twoFactorChallengeHandler)
+	http.HandleFunc("/signin/passkey/begin", beginPasskeySignInHandler)
+	http.HandleFunc("/signin/passkey/finish", finishPasskeySignInHandler)
+	http.HandleFunc("/users", requirePermission(permUsersList, getUsersHandler))
+	http.HandleFunc("/auth/", oauthHandler)
 	http.HandleFunc("/welcome", welcomeHandler)
 	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/link", linkHandler)
+	http.HandleFunc("/account/identities", identitiesHandler)
+	http.HandleFunc("/account/identities/unlink", unlinkIdentityHandler)
+	http.HandleFunc("/account/2fa", twoFactorPageHandler)
+	http.HandleFunc("/account/2fa/setup", twoFactorSetupHandler)
+	http.HandleFunc("/account/2fa/qr", twoFactorQRHandler)
+	http.HandleFunc("/account/2fa/enable", twoFactorEnableHandler)
+	http.HandleFunc("/account/2fa/disable", twoFactorDisableHandler)
+	http.HandleFunc("/account/2fa/recovery-codes", recoveryCodesHandler)
+	http.HandleFunc("/account/passkeys", passkeysHandler)
+	http.HandleFunc("/account/passkeys/manage", passkeysPageHandler)
+	http.HandleFunc("/account/passkeys/register/begin", beginPasskeyRegistrationHandler)
+	http.HandleFunc("/account/passkeys/register/finish", finishPasskeyRegistrationHandler)
+	http.HandleFunc("/account/passkeys/rename", renamePasskeyHandler)
+	http.HandleFunc("/account/passkeys/delete", deletePasskeyHandler)
+	http.HandleFunc("/password/forgot", forgotPasswordHandler)
+	http.HandleFunc("/password/reset", resetPasswordHandler)
+	http.HandleFunc("/account/password", accountPasswordHandler)
+	http.HandleFunc("/account/sessions", sessionsHandler)
+	http.HandleFunc("/account/sessions/manage", sessionsPageHandler)
+	http.HandleFunc("/account/sessions/revoke", revokeSessionHandler)
+	http.HandleFunc("/account/remembered", persistentLoginsHandler)
+	http.HandleFunc("/account/remembered/revoke", revokePersistentLoginHandler)
+	http.HandleFunc("/verify", verifyEmailHandler)
+	http.HandleFunc("/verify/resend", resendVerificationHandler)
+	http.HandleFunc("/admin/unlock", requirePermission(permUsersUnlock, unlockHandler))
+	http.HandleFunc("/admin/password-report", requirePermission(permPasswordReport, passwordReportHandler))
+	http.HandleFunc("/admin/sessions/revoke", requirePermission(permSessionsRevoke, revokeUserSessionsHandler))
+	http.HandleFunc("/admin/roles/grant", requirePermission(permRolesManage, roleHandler(true)))
+	http.HandleFunc("/admin/roles/revoke", requirePermission(permRolesManage, roleHandler(false)))
+	http.HandleFunc("/admin/users/view", requirePermission(permUsersView, adminUserHandler))
+	http.HandleFunc("/admin/users/suspend", requirePermission(permUsersSuspend, suspendUserHandler))
+	http.HandleFunc("/admin/users/reactivate", requirePermission(permUsersSuspend, reactivateUserHandler))
+	http.HandleFunc("/admin/users/reset-password", requirePermission(permUsersReset, forcePasswordResetHandler))
+	http.HandleFunc("/admin/users/remove-2fa", requirePermission(permUsersReset, removeTwoFactorHandler))
+	http.HandleFunc("/admin/users/delete", requirePermission(permUsersDelete, deleteUserHandler))
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	// Add a simple health check route
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +198,7 @@ func main() {
 	// Use http.Server for more control
 	server := &http.Server{
 		Addr:     ":8080",
-		Handler:  nil, // Use default ServeMux
+		Handler:  withCSRFProtection(withRememberedSignIn(http.DefaultServeMux)),
 		ErrorLog: log.New(os.Stderr, "HTTP Server Error: ", log.Ldate|log.Ltime|log.Lshortfile),
 	}
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTestServer configures the in-memory store and the sessions, password
+// hashing and sign-in policies from their defaults, so handlers can be
+// called directly.
+func setupTestServer(t *testing.T) {
+	t.Helper()
+	t.Setenv("STORE_BACKEND", "memory")
+	for _, setup := range []func() error{initStore, initSessionStores, initPasswordHasher, loadUnverifiedLoginPolicy} {
+		if err := setup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// createTestUser stores a verified user with password.
+func createTestUser(t *testing.T, username, password string) User {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	user := User{MembershipID: generateMembershipID(), Username: username, Email: username + "@example.com", EmailVerifiedAt: &now, Password: hash}
+	if err := userStore.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// serve calls handler with a request carrying cookies and returns the
+// response.
+func serve(handler http.HandlerFunc, method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// responseCookie returns the cookie named name set by a response, or nil.
+// If it was set more than once, the last one wins, as in a browser.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	var found *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			found = cookie
+		}
+	}
+	return found
+}
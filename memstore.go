@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a thread-safe, process-local UserStore and MailQueue for
+// tests and local demos. It enforces the same uniqueness rules as the users
+// table.
+type memoryStore struct {
+	mu         sync.RWMutex
+	nextID     int
+	users      map[int]User
+	identities []Identity
+	passkeys   []Passkey
+	tokens     []AccountToken
+	mail       []QueuedEmail
+	// totpSteps and recoveryCodes are keyed by user ID.
+	totpSteps     map[int]int64
+	recoveryCodes map[int]map[string]bool
+	// loginThrottles is keyed by scope and subject.
+	loginThrottles map[[2]string]LoginThrottle
+	auditEvents    []AuditEvent
+	// sessions and persistentLogins are keyed by token hash.
+	sessions         map[string]SessionRecord
+	persistentLogins map[string]PersistentLogin
+	// usedOAuthStates maps state hashes to their expiry.
+	usedOAuthStates map[string]time.Time
+	// rolePermissions is keyed by role name, seeded like migration 0011;
+	// userRoles by user ID.
+	rolePermissions map[string][]string
+	userRoles       map[int][]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextID:           1,
+		users:            make(map[int]User),
+		totpSteps:        make(map[int]int64),
+		recoveryCodes:    make(map[int]map[string]bool),
+		loginThrottles:   make(map[[2]string]LoginThrottle),
+		sessions:         make(map[string]SessionRecord),
+		persistentLogins: make(map[string]PersistentLogin),
+		usedOAuthStates:  make(map[string]time.Time),
+		rolePermissions:  map[string][]string{roleAdmin: adminPermissions},
+		userRoles:        make(map[int][]string),
+	}
+}
+
+// conflicts reports whether another user already has user's username,
+// email or membership ID, or has an email equal to its username or the other
+// way round, since lookups accept either. Callers must hold s.mu.
+func (s *memoryStore) conflicts(user User) bool {
+	for id, existing := range s.users {
+		if id == user.ID {
+			continue
+		}
+		if existing.Username == user.Username || existing.MembershipID == user.MembershipID {
+			return true
+		}
+		if user.Email != "" && strings.EqualFold(existing.Email, user.Email) {
+			return true
+		}
+		if existing.Email != "" && strings.EqualFold(existing.Email, user.Username) {
+			return true
+		}
+		if user.Email != "" && strings.EqualFold(existing.Username, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.ID = 0
+	if s.conflicts(*user) {
+		return ErrUserExists
+	}
+
+	user.ID = s.nextID
+	s.nextID++
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *memoryStore) findUser(match func(User) bool) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (s *memoryStore) GetUser(usernameOrEmail string) (User, error) {
+	user, err := s.findUser(func(u User) bool { return u.Username == usernameOrEmail })
+	if err == ErrUserNotFound {
+		return s.findUser(func(u User) bool { return u.Email != "" && strings.EqualFold(u.Email, usernameOrEmail) })
+	}
+	return user, err
+}
+
+func (s *memoryStore) GetUserByID(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByMembershipID(membershipID string) (User, error) {
+	return s.findUser(func(u User) bool { return u.MembershipID == membershipID })
+}
+
+func (s *memoryStore) GetUserByIdentity(provider, subject string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, identity := range s.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return s.users[identity.UserID], nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (s *memoryStore) ListUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		user.Password = ""
+		user.TOTPSecret = ""
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryStore) ListPasswordHashes() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hashes []string
+	for _, user := range s.users {
+		if user.Password != "" {
+			hashes = append(hashes, user.Password)
+		}
+	}
+	return hashes, nil
+}
+
+func (s *memoryStore) UpdateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[user.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if s.conflicts(user) {
+		return ErrUserExists
+	}
+
+	existing.Username = user.Username
+	if !strings.EqualFold(existing.Email, user.Email) {
+		existing.EmailVerifiedAt = nil
+	}
+	existing.Email = user.Email
+	existing.Password = user.Password
+	s.users[user.ID] = existing
+	return nil
+}
+
+func (s *memoryStore) MarkEmailVerified(userID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || user.Email == "" || !strings.EqualFold(user.Email, email) {
+		return ErrUserNotFound
+	}
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+
+	// Mirror ON DELETE CASCADE.
+	identities := s.identities[:0]
+	for _, identity := range s.identities {
+		if identity.UserID != id {
+			identities = append(identities, identity)
+		}
+	}
+	s.identities = identities
+
+	tokens := s.tokens[:0]
+	for _, token := range s.tokens {
+		if token.UserID != id {
+			tokens = append(tokens, token)
+		}
+	}
+	s.tokens = tokens
+
+	passkeys := s.passkeys[:0]
+	for _, passkey := range s.passkeys {
+		if passkey.UserID != id {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	s.passkeys = passkeys
+
+	delete(s.totpSteps, id)
+	delete(s.recoveryCodes, id)
+	delete(s.userRoles, id)
+	s.deleteUserSessions(id)
+
+	// Mirror ON DELETE SET NULL.
+	for i := range s.auditEvents {
+		if s.auditEvents[i].UserID == id {
+			s.auditEvents[i].UserID = 0
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SuspendUser(userID int, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.SuspendedAt == nil {
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+	user.SuspensionReason = reason
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) ReactivateUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.SuspendedAt = nil
+	user.SuspensionReason = ""
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) CreateIdentity(identity *Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[identity.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	for _, existing := range s.identities {
+		if existing.Provider == identity.Provider && existing.Subject == identity.Subject {
+			return ErrIdentityExists
+		}
+	}
+
+	identity.ID = s.nextID
+	s.nextID++
+	identity.CreatedAt = time.Now()
+	s.identities = append(s.identities, *identity)
+	return nil
+}
+
+func (s *memoryStore) ListIdentities(userID int) ([]Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var identities []Identity
+	for _, identity := range s.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (s *memoryStore) DeleteIdentity(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, identity := range s.identities {
+		if identity.ID == id && identity.UserID == userID {
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			return nil
+		}
+	}
+	return ErrIdentityNotFound
+}
+
+func (s *memoryStore) InvalidateSessions(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.SessionEpoch++
+	s.users[userID] = user
+	s.deleteUserSessions(userID)
+	return nil
+}
+
+// deleteUserSessions deletes every session and persistent login of user
+// userID. Callers must hold s.mu.
+func (s *memoryStore) deleteUserSessions(userID int) {
+	for tokenHash, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, tokenHash)
+		}
+	}
+	for tokenHash, login := range s.persistentLogins {
+		if login.UserID == userID {
+			delete(s.persistentLogins, tokenHash)
+		}
+	}
+}
+
+func (s *memoryStore) CreateSession(session *SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session.ID = s.nextID
+	s.nextID++
+	session.CreatedAt = time.Now()
+	session.LastSeenAt = session.CreatedAt
+	s.sessions[session.TokenHash] = *session
+	return nil
+}
+
+func (s *memoryStore) GetSession(tokenHash string) (SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok || !time.Now().Before(session.ExpiresAt) {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *memoryStore) UpdateSession(session SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.sessions[session.TokenHash]
+	if !ok || !time.Now().Before(existing.ExpiresAt) {
+		return ErrSessionNotFound
+	}
+	existing.UserID = session.UserID
+	existing.Data = session.Data
+	existing.ExpiresAt = session.ExpiresAt
+	s.sessions[session.TokenHash] = existing
+	return nil
+}
+
+func (s *memoryStore) TouchSession(tokenHash, ipAddress, userAgent string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[tokenHash]
+	if ok {
+		session.LastSeenAt = time.Now()
+		session.IPAddress = ipAddress
+		session.UserAgent = userAgent
+		session.ExpiresAt = expiresAt
+		s.sessions[tokenHash] = session
+	}
+	return nil
+}
+
+func (s *memoryStore) ListSessions(userID int) ([]SessionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var sessions []SessionRecord
+	for _, session := range s.sessions {
+		if session.UserID == userID && now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (s *memoryStore) DeleteSession(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.sessions {
+		if session.ID == id && session.UserID == userID {
+			delete(s.sessions, tokenHash)
+			return nil
+		}
+	}
+	return ErrSessionNotFound
+}
+
+func (s *memoryStore) DeleteSessionByToken(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *memoryStore) DeleteExpiredSessions() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for tokenHash, session := range s.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.sessions, tokenHash)
+			deleted++
+		}
+	}
+	for tokenHash, login := range s.persistentLogins {
+		if !now.Before(login.ExpiresAt) {
+			delete(s.persistentLogins, tokenHash)
+			deleted++
+		}
+	}
+	for stateHash, expiresAt := range s.usedOAuthStates {
+		if !now.Before(expiresAt) {
+			delete(s.usedOAuthStates, stateHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) CreatePersistentLogin(login *PersistentLogin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login.ID = s.nextID
+	s.nextID++
+	login.CreatedAt = time.Now()
+	login.LastUsedAt = login.CreatedAt
+	s.persistentLogins[login.TokenHash] = *login
+	return nil
+}
+
+func (s *memoryStore) GetPersistentLogin(tokenHash string) (PersistentLogin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	login, ok := s.persistentLogins[tokenHash]
+	if !ok || !time.Now().Before(login.ExpiresAt) {
+		return PersistentLogin{}, ErrLoginNotFound
+	}
+	return login, nil
+}
+
+func (s *memoryStore) TouchPersistentLogin(id int, ipAddress, userAgent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, login := range s.persistentLogins {
+		if login.ID == id {
+			login.LastUsedAt = time.Now()
+			login.IPAddress = ipAddress
+			login.UserAgent = userAgent
+			s.persistentLogins[tokenHash] = login
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListPersistentLogins(userID int) ([]PersistentLogin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var logins []PersistentLogin
+	for _, login := range s.persistentLogins {
+		if login.UserID == userID && now.Before(login.ExpiresAt) {
+			logins = append(logins, login)
+		}
+	}
+	sort.Slice(logins, func(i, j int) bool { return logins[i].LastUsedAt.After(logins[j].LastUsedAt) })
+	return logins, nil
+}
+
+func (s *memoryStore) DeletePersistentLogin(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, login := range s.persistentLogins {
+		if login.ID == id && login.UserID == userID {
+			delete(s.persistentLogins, tokenHash)
+			return nil
+		}
+	}
+	return ErrLoginNotFound
+}
+
+func (s *memoryStore) DeletePersistentLoginByToken(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.persistentLogins, tokenHash)
+	return nil
+}
+
+func (s *memoryStore) ListUserRoles(userID int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.userRoles[userID]...), nil
+}
+
+func (s *memoryStore) ListUserPermissions(userID int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var permissions []string
+	for _, role := range s.userRoles[userID] {
+		for _, permission := range s.rolePermissions[role] {
+			if !containsString(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+func (s *memoryStore) AssignRole(userID int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rolePermissions[role]; !ok {
+		return ErrRoleNotFound
+	}
+	if !containsString(s.userRoles[userID], role) {
+		s.userRoles[userID] = append(s.userRoles[userID], role)
+		sort.Strings(s.userRoles[userID])
+	}
+	return nil
+}
+
+func (s *memoryStore) RemoveRole(userID int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var roles []string
+	for _, existing := range s.userRoles[userID] {
+		if existing != role {
+			roles = append(roles, existing)
+		}
+	}
+	s.userRoles[userID] = roles
+	return nil
+}
+
+func (s *memoryStore) CountUsersWithRole(role string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, roles := range s.userRoles {
+		if containsString(roles, role) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CreateToken(token *AccountToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[token.UserID]; !ok {
+		return ErrUserNotFound
+	}
+
+	tokens := s.tokens[:0]
+	for _, existing := range s.tokens {
+		if existing.UserID == token.UserID && existing.Purpose == token.Purpose && existing.ConsumedAt == nil {
+			continue
+		}
+		tokens = append(tokens, existing)
+	}
+
+	token.ID = s.nextID
+	s.nextID++
+	token.ConsumedAt = nil
+	token.CreatedAt = time.Now()
+	s.tokens = append(tokens, *token)
+	return nil
+}
+
+func (s *memoryStore) ConsumeToken(purpose, tokenHash string) (AccountToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i, token := range s.tokens {
+		if token.TokenHash != tokenHash || token.Purpose != purpose {
+			continue
+		}
+		if token.ConsumedAt != nil || !now.Before(token.ExpiresAt) {
+			return AccountToken{}, ErrTokenInvalid
+		}
+		token.ConsumedAt = &now
+		s.tokens[i] = token
+		return token, nil
+	}
+	return AccountToken{}, ErrTokenInvalid
+}
+
+func (s *memoryStore) UseOAuthState(stateHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, used := s.usedOAuthStates[stateHash]; used {
+		return ErrTokenInvalid
+	}
+	s.usedOAuthStates[stateHash] = expiresAt
+	return nil
+}
+
+func (s *memoryStore) GetToken(purpose, tokenHash string) (AccountToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.TokenHash != tokenHash || token.Purpose != purpose {
+			continue
+		}
+		if token.ConsumedAt != nil || !now.Before(token.ExpiresAt) {
+			return AccountToken{}, ErrTokenInvalid
+		}
+		return token, nil
+	}
+	return AccountToken{}, ErrTokenInvalid
+}
+
+func (s *memoryStore) LastTokenCreatedAt(userID int, purpose string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last time.Time
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.Purpose == purpose && token.CreatedAt.After(last) {
+			last = token.CreatedAt
+		}
+	}
+	return last, nil
+}
+
+func (s *memoryStore) EnqueueEmail(email *QueuedEmail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email.ID = s.nextID
+	s.nextID++
+	email.Status = mailStatusPending
+	email.Attempts = 0
+	email.CreatedAt = time.Now()
+	email.NextAttemptAt = email.CreatedAt
+	s.mail = append(s.mail, *email)
+	return nil
+}
+
+func (s *memoryStore) ClaimEmails(limit int, lease time.Duration) ([]QueuedEmail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var claimed []QueuedEmail
+	for i, email := range s.mail {
+		if len(claimed) == limit {
+			break
+		}
+		if email.Status != mailStatusPending || email.NextAttemptAt.After(now) {
+			continue
+		}
+		email.Attempts++
+		email.NextAttemptAt = now.Add(lease)
+		s.mail[i] = email
+		claimed = append(claimed, email)
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) updateEmail(id int, update func(*QueuedEmail)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.mail {
+		if s.mail[i].ID == id {
+			update(&s.mail[i])
+			return nil
+		}
+	}
+	return fmt.Errorf("queued email %d not found", id)
+}
+
+func (s *memoryStore) MarkEmailSent(id int) error {
+	return s.updateEmail(id, func(email *QueuedEmail) {
+		now := time.Now()
+		email.Status = mailStatusSent
+		email.SentAt = &now
+		email.LastError = ""
+		email.Email.Text = ""
+		email.Email.HTML = ""
+	})
+}
+
+func (s *memoryStore) MarkEmailFailed(id int, lastError string, retryAt time.Time) error {
+	return s.updateEmail(id, func(email *QueuedEmail) {
+		email.LastError = lastError
+		if retryAt.IsZero() {
+			email.Status = mailStatusFailed
+			email.Email.Text = ""
+			email.Email.HTML = ""
+		} else {
+			email.NextAttemptAt = retryAt
+		}
+	})
+}
+
+func (s *memoryStore) modifyUser(userID int, update func(*User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	update(&user)
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) SetTOTPSecret(userID int, secret string) error {
+	return s.modifyUser(userID, func(user *User) {
+		user.TOTPSecret = secret
+		user.TwoFactorEnabled = false
+	})
+}
+
+func (s *memoryStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || user.TOTPSecret == "" {
+		return ErrUserNotFound
+	}
+	user.TwoFactorEnabled = true
+	s.users[userID] = user
+	s.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+func (s *memoryStore) DisableTOTP(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.TOTPSecret = ""
+	user.TwoFactorEnabled = false
+	s.users[userID] = user
+	s.replaceRecoveryCodes(userID, nil)
+	return nil
+}
+
+func (s *memoryStore) UseTOTPStep(userID int, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	if step <= s.totpSteps[userID] {
+		return ErrCodeInvalid
+	}
+	s.totpSteps[userID] = step
+	return nil
+}
+
+func (s *memoryStore) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	s.replaceRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+// replaceRecoveryCodes maps each code hash to whether it has been used.
+// Callers must hold s.mu.
+func (s *memoryStore) replaceRecoveryCodes(userID int, codeHashes []string) {
+	codes := make(map[string]bool, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		codes[codeHash] = false
+	}
+	s.recoveryCodes[userID] = codes
+}
+
+func (s *memoryStore) UseRecoveryCode(userID int, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.recoveryCodes[userID][codeHash]
+	if !ok || used {
+		return ErrCodeInvalid
+	}
+	s.recoveryCodes[userID][codeHash] = true
+	return nil
+}
+
+func (s *memoryStore) CountRecoveryCodes(userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, used := range s.recoveryCodes[userID] {
+		if !used {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CreatePasskey(passkey *Passkey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[passkey.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	for _, existing := range s.passkeys {
+		if bytes.Equal(existing.CredentialID, passkey.CredentialID) {
+			return ErrPasskeyExists
+		}
+	}
+
+	passkey.ID = s.nextID
+	s.nextID++
+	passkey.CreatedAt = time.Now()
+	s.passkeys = append(s.passkeys, *passkey)
+	return nil
+}
+
+func (s *memoryStore) ListPasskeys(userID int) ([]Passkey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var passkeys []Passkey
+	for _, passkey := range s.passkeys {
+		if passkey.UserID == userID {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	return passkeys, nil
+}
+
+func (s *memoryStore) GetPasskeyByCredentialID(credentialID []byte) (Passkey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, passkey := range s.passkeys {
+		if bytes.Equal(passkey.CredentialID, credentialID) {
+			return passkey, nil
+		}
+	}
+	return Passkey{}, ErrPasskeyNotFound
+}
+
+func (s *memoryStore) UpdatePasskeyUsage(id int, signCount uint32, backupState bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.passkeys {
+		if s.passkeys[i].ID == id {
+			now := time.Now()
+			s.passkeys[i].SignCount = signCount
+			s.passkeys[i].BackupState = backupState
+			s.passkeys[i].LastUsedAt = &now
+			return nil
+		}
+	}
+	return ErrPasskeyNotFound
+}
+
+func (s *memoryStore) RenamePasskey(userID, id int, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.passkeys {
+		if s.passkeys[i].ID == id && s.passkeys[i].UserID == userID {
+			s.passkeys[i].Name = name
+			return nil
+		}
+	}
+	return ErrPasskeyNotFound
+}
+
+func (s *memoryStore) DeletePasskey(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, passkey := range s.passkeys {
+		if passkey.ID == id && passkey.UserID == userID {
+			s.passkeys = append(s.passkeys[:i], s.passkeys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrPasskeyNotFound
+}
+
+// loginDelayAfter returns the lock for the nth failure from delays.
+func loginDelayAfter(delays []time.Duration, failures int) time.Duration {
+	if failures < 1 || len(delays) == 0 {
+		return 0
+	}
+	if failures > len(delays) {
+		failures = len(delays)
+	}
+	return delays[failures-1]
+}
+
+func (s *memoryStore) ReserveLoginAttempt(scope, subject string, window time.Duration, delays []time.Duration) (LoginThrottle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key := [2]string{scope, subject}
+	throttle, ok := s.loginThrottles[key]
+	if ok && now.Before(throttle.LockedUntil) {
+		return throttle, false, nil
+	}
+	if !ok || throttle.LastFailureAt.Before(now.Add(-window)) {
+		throttle = LoginThrottle{Scope: scope, Subject: subject}
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	throttle.LockedUntil = now.Add(loginDelayAfter(delays, throttle.Failures))
+	s.loginThrottles[key] = throttle
+	return throttle, true, nil
+}
+
+func (s *memoryStore) ReleaseLoginAttempt(scope, subject string, delays []time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]string{scope, subject}
+	throttle, ok := s.loginThrottles[key]
+	if !ok || throttle.Failures == 0 {
+		return nil
+	}
+	throttle.Failures--
+	throttle.LockedUntil = time.Time{}
+	if throttle.Failures > 0 {
+		throttle.LockedUntil = throttle.LastFailureAt.Add(loginDelayAfter(delays, throttle.Failures))
+	}
+	s.loginThrottles[key] = throttle
+	return nil
+}
+
+func (s *memoryStore) GetLoginThrottle(scope, subject string) (LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	throttle, ok := s.loginThrottles[[2]string{scope, subject}]
+	if !ok {
+		return LoginThrottle{Scope: scope, Subject: subject}, nil
+	}
+	return throttle, nil
+}
+
+func (s *memoryStore) ClearLoginFailures(scope, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, [2]string{scope, subject})
+	return nil
+}
+
+func (s *memoryStore) RecordAuditEvent(event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = s.nextID
+	s.nextID++
+	event.CreatedAt = time.Now()
+	s.auditEvents = append(s.auditEvents, *event)
+	return nil
+}
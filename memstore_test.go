@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreCRUD(t *testing.T) {
+	s := newMemoryStore()
+
+	user := User{MembershipID: "M1", Username: "alice", Password: "hash-1"}
+	if err := s.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 {
+		t.Fatal("CreateUser didn't fill in the ID")
+	}
+
+	got, err := s.GetUser("alice")
+	if err != nil || got.ID != user.ID || got.Password != "hash-1" {
+		t.Fatalf("GetUser: got %+v, err %v", got, err)
+	}
+	got, err = s.GetUserByMembershipID("M1")
+	if err != nil || got.ID != user.ID {
+		t.Fatalf("GetUserByMembershipID: got %+v, err %v", got, err)
+	}
+	if _, err := s.GetUser("bob"); err != ErrUserNotFound {
+		t.Fatalf("GetUser of a missing user: got %v, want ErrUserNotFound", err)
+	}
+
+	user.Username = "alice2"
+	user.Password = "hash-2"
+	if err := s.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetUser("alice2")
+	if err != nil || got.Password != "hash-2" {
+		t.Fatalf("after UpdateUser: got %+v, err %v", got, err)
+	}
+	if err := s.UpdateUser(User{ID: 99, Username: "nobody"}); err != ErrUserNotFound {
+		t.Fatalf("UpdateUser of a missing user: got %v, want ErrUserNotFound", err)
+	}
+
+	users, err := s.ListUsers()
+	if err != nil || len(users) != 1 || users[0].Username != "alice2" {
+		t.Fatalf("ListUsers: got %+v, err %v", users, err)
+	}
+	if users[0].Password != "" {
+		t.Fatal("ListUsers returned the password hash")
+	}
+
+	if err := s.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser("alice2"); err != ErrUserNotFound {
+		t.Fatalf("GetUser after DeleteUser: got %v, want ErrUserNotFound", err)
+	}
+	if err := s.DeleteUser(user.ID); err != ErrUserNotFound {
+		t.Fatalf("DeleteUser twice: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestMemoryStoreConflicts(t *testing.T) {
+	s := newMemoryStore()
+	alice := User{MembershipID: "M1", Username: "alice"}
+	bob := User{MembershipID: "M2", Username: "bob"}
+	for _, user := range []*User{&alice, &bob} {
+		if err := s.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		user User
+	}{
+		{"same username", User{MembershipID: "M3", Username: "alice"}},
+		{"same membership ID", User{MembershipID: "M1", Username: "carol"}},
+	} {
+		user := test.user
+		if err := s.CreateUser(&user); err != ErrUserExists {
+			t.Errorf("create with %s: got %v, want ErrUserExists", test.name, err)
+		}
+	}
+
+	bob.Username = "alice"
+	if err := s.UpdateUser(bob); err != ErrUserExists {
+		t.Fatalf("rename to a taken username: got %v, want ErrUserExists", err)
+	}
+	// Saving a user unchanged isn't a conflict with itself
+	if err := s.UpdateUser(alice); err != nil {
+		t.Fatalf("update without changes: %v", err)
+	}
+}
+
+func TestMemoryStoreConcurrentCreate(t *testing.T) {
+	s := newMemoryStore()
+	const n = 50
+
+	// Everyone races for the same username; exactly one wins
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{MembershipID: fmt.Sprintf("SAME%d", i), Username: "same"}
+			errs <- s.CreateUser(&user)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrUserExists:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("created %d users named same, want 1", created)
+	}
+
+	// One half races for a username that the other half want as their
+	// email; exactly one of them wins
+	errs = make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{MembershipID: fmt.Sprintf("CROSS%d", i), Username: "cross@example.com"}
+			if i%2 == 1 {
+				user.Username = fmt.Sprintf("cross%d", i)
+				user.Email = "Cross@example.com"
+			}
+			errs <- s.CreateUser(&user)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created = 0
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrUserExists:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("created %d users claiming cross@example.com, want 1", created)
+	}
+
+	// Different usernames all get created, with distinct IDs
+	ids := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{MembershipID: fmt.Sprintf("M%d", i), Username: fmt.Sprintf("user%d", i)}
+			if err := s.CreateUser(&user); err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- user.ID
+			if _, err := s.GetUser(user.Username); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %d given out twice", id)
+		}
+		seen[id] = true
+	}
+	if users, _ := s.ListUsers(); len(users) != n+2 {
+		t.Fatalf("got %d users, want %d", len(users), n+2)
+	}
+}
+
+func TestInitStoreBackend(t *testing.T) {
+	t.Setenv("STORE_BACKEND", "memory")
+	if err := initStore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := userStore.(*memoryStore); !ok {
+		t.Fatalf("STORE_BACKEND=memory: got %T", userStore)
+	}
+
+	t.Setenv("STORE_BACKEND", "mysql")
+	if err := initStore(); err == nil {
+		t.Fatal("unknown STORE_BACKEND accepted")
+	}
+}
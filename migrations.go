@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the pg_advisory_lock key held while migrations run, so
+// that two instances starting at the same time don't apply them twice.
+const migrationLockID = 727384651
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type migrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the embedded migration files and returns them sorted
+// by version. Every version must have an up migration; down is optional.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %v", err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %v", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock. Advisory locks belong to the session, so the lock, the
+// migrations and the unlock must all use the same connection.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %v", err)
+	}
+	defer conn.Close()
+
+	log.Println("Waiting for migration lock...")
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("error acquiring migration lock: %v", err)
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// applyMigration runs one migration script and records (or removes) its
+// version in schema_migrations inside a single transaction.
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script := m.Up
+	if !up {
+		script = m.Down
+	}
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in version order. With dryRun
+// set, nothing is executed and the pending migrations are only returned.
+func migrateUp(db *sql.DB, dryRun bool) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	ctx := context.Background()
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("error reading applied migrations: %v", err)
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			pending = append(pending, m)
+			if dryRun {
+				continue
+			}
+
+			log.Printf("Applying migration %04d_%s", m.Version, m.Name)
+			err := applyMigration(ctx, conn, m, true)
+			if err != nil {
+				return fmt.Errorf("error applying migration %04d_%s: %v", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+
+	return pending, err
+}
+
+// migrateDown reverts the last steps applied migrations, newest first.
+func migrateDown(db *sql.DB, steps int, dryRun bool) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []migration
+	ctx := context.Background()
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("error reading applied migrations: %v", err)
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s cannot be reverted: no down file", m.Version, m.Name)
+			}
+			reverted = append(reverted, m)
+			if dryRun {
+				continue
+			}
+
+			log.Printf("Reverting migration %04d_%s", m.Version, m.Name)
+			err := applyMigration(ctx, conn, m, false)
+			if err != nil {
+				return fmt.Errorf("error reverting migration %04d_%s: %v", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+func getMigrationStatus(db *sql.DB) ([]migrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	ctx := context.Background()
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("error reading applied migrations: %v", err)
+		}
+
+		for _, m := range migrations {
+			appliedAt, ok := applied[m.Version]
+			statuses = append(statuses, migrationStatus{
+				Version:   m.Version,
+				Name:      m.Name,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// runMigrateCommand implements `migrate up|down|status`. It is invoked from
+// main before the HTTP server is set up.
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status [-dry-run] [-steps n]")
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migrations that would run without applying them")
+	steps := flags.Int("steps", 1, "number of migrations to revert (down only)")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	err = openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		pending, err := migrateUp(db, *dryRun)
+		if err != nil {
+			return err
+		}
+		printMigrations(pending, *dryRun, true)
+	case "down":
+		reverted, err := migrateDown(db, *steps, *dryRun)
+		if err != nil {
+			return err
+		}
+		printMigrations(reverted, *dryRun, false)
+	case "status":
+		statuses, err := getMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Fprintf(os.Stdout, "%04d_%-40s applied %s\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(os.Stdout, "%04d_%-40s pending\n", s.Version, s.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+
+	return nil
+}
+
+func printMigrations(migrations []migration, dryRun bool, up bool) {
+	verb, done, script := "apply", "Applied", func(m migration) string { return m.Up }
+	if !up {
+		verb, done, script = "revert", "Reverted", func(m migration) string { return m.Down }
+	}
+
+	if len(migrations) == 0 {
+		fmt.Fprintf(os.Stdout, "Nothing to %s\n", verb)
+		return
+	}
+
+	for _, m := range migrations {
+		if dryRun {
+			fmt.Fprintf(os.Stdout, "-- would %s %04d_%s\n%s\n", verb, m.Version, m.Name, script(m))
+		} else {
+			fmt.Fprintf(os.Stdout, "%s %04d_%s\n", done, m.Version, m.Name)
+		}
+	}
+}
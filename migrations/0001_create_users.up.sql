@@ -0,0 +1,36 @@
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    membership_id CHAR(16) UNIQUE,
+    username VARCHAR(50) UNIQUE NOT NULL,
+    password VARCHAR(100) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Databases created before membership IDs existed are missing the column.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS membership_id CHAR(16) UNIQUE;
+
+-- Backfill membership IDs using the same rules as generateMembershipID:
+-- 16 characters from A-Z0-9 with no character repeated back to back.
+DO $$
+DECLARE
+    r RECORD;
+    charset TEXT := 'ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789';
+    new_id TEXT;
+    c TEXT;
+BEGIN
+    FOR r IN SELECT id FROM users WHERE membership_id IS NULL LOOP
+        LOOP
+            new_id := '';
+            WHILE length(new_id) < 16 LOOP
+                c := substr(charset, 1 + floor(random() * length(charset))::int, 1);
+                IF new_id = '' OR right(new_id, 1) <> c THEN
+                    new_id := new_id || c;
+                END IF;
+            END LOOP;
+            EXIT WHEN NOT EXISTS (SELECT 1 FROM users WHERE membership_id = new_id);
+        END LOOP;
+        UPDATE users SET membership_id = new_id WHERE id = r.id;
+    END LOOP;
+END $$;
+
+ALTER TABLE users ALTER COLUMN membership_id SET NOT NULL;
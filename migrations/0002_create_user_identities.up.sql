@@ -0,0 +1,22 @@
+ALTER TABLE users ADD COLUMN email VARCHAR(255);
+
+-- Accounts created through Google OAuth used the email address as the
+-- username. Carry those over, skipping addresses that differ only by case.
+UPDATE users SET email = lower(username)
+WHERE username LIKE '%@%'
+  AND id IN (SELECT min(id) FROM users WHERE username LIKE '%@%' GROUP BY lower(username));
+
+CREATE UNIQUE INDEX users_email_key ON users (lower(email));
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
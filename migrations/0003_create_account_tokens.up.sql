@@ -0,0 +1,17 @@
+-- Bumped whenever all of a user's sessions must end, e.g. after a password
+-- reset. Sessions remember the epoch they were started in.
+ALTER TABLE users ADD COLUMN session_epoch INTEGER NOT NULL DEFAULT 0;
+
+-- Single-use tokens mailed to users (password reset, ...). Only a SHA-256
+-- hash of the token is stored.
+CREATE TABLE account_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX account_tokens_user_id_idx ON account_tokens (user_id, purpose);
@@ -0,0 +1,2 @@
+ALTER TABLE account_tokens DROP COLUMN IF EXISTS email;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
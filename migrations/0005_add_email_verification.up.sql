@@ -0,0 +1,15 @@
+-- NULL until the user proves they receive mail at users.email.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+
+-- Accounts created through OAuth took their email from the provider; count
+-- it as verified when the provider said so.
+UPDATE users SET email_verified_at = CURRENT_TIMESTAMP
+WHERE EXISTS (
+    SELECT 1 FROM user_identities
+    WHERE user_identities.user_id = users.id
+      AND user_identities.email_verified
+      AND lower(user_identities.email) = lower(users.email)
+);
+
+-- The address a token was sent to, for tokens that prove ownership of one.
+ALTER TABLE account_tokens ADD COLUMN email VARCHAR(255);
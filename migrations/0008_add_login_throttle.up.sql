@@ -0,0 +1,26 @@
+-- Failed sign-in counters, shared by every instance. scope is 'account'
+-- (subject is the user ID) or 'ip' (subject is the client address).
+-- locked_until is when the next attempt is allowed.
+CREATE TABLE login_failures (
+    scope VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, subject)
+);
+
+-- Security-relevant events (lockouts, unlocks, ...) for auditing.
+-- user_id is kept NULL rather than deleting the event when the user goes.
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
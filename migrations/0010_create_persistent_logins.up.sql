@@ -0,0 +1,16 @@
+-- "Remember me" logins. Each one signs its browser back in when its
+-- session has expired, until expires_at. Only the token's SHA-256 is
+-- stored.
+CREATE TABLE persistent_logins (
+    id SERIAL PRIMARY KEY,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX persistent_logins_user_id_idx ON persistent_logins (user_id);
+CREATE INDEX persistent_logins_expires_at_idx ON persistent_logins (expires_at);
@@ -0,0 +1,35 @@
+-- Role-based access control. A role grants a set of permissions (names
+-- like 'users.list', checked in code); users get permissions through the
+-- roles assigned to them.
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission VARCHAR(64) NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    granted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX user_roles_role_id_idx ON user_roles (role_id);
+
+INSERT INTO roles (name, description) VALUES ('admin', 'Full access to the admin endpoints');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, permission FROM roles, (VALUES
+    ('users.list'),
+    ('users.unlock'),
+    ('sessions.revoke'),
+    ('passwords.report'),
+    ('roles.manage')
+) AS p (permission)
+WHERE name = 'admin';
@@ -0,0 +1,3 @@
+DELETE FROM role_permissions WHERE permission IN ('users.view', 'users.suspend', 'users.reset', 'users.delete');
+ALTER TABLE users DROP COLUMN IF EXISTS suspension_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS suspended_at;
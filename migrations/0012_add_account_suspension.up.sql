@@ -0,0 +1,15 @@
+-- Set while an admin has suspended the account, which can't sign in until
+-- it is reactivated. The reason is shown to other admins; who suspended it
+-- is in the audit log.
+ALTER TABLE users ADD COLUMN suspended_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN suspension_reason TEXT;
+
+-- Permissions for the user management endpoints.
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, permission FROM roles, (VALUES
+    ('users.view'),
+    ('users.suspend'),
+    ('users.reset'),
+    ('users.delete')
+) AS p (permission)
+WHERE name = 'admin';
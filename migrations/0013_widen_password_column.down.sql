@@ -0,0 +1,2 @@
+-- Fails if a stored hash is longer than 100 characters.
+ALTER TABLE users ALTER COLUMN password TYPE VARCHAR(100);
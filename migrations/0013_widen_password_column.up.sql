@@ -0,0 +1,3 @@
+-- Password hashes outgrow VARCHAR(100): an argon2id hash with large
+-- ARGON2_* settings, or an imported legacy hash, can be longer.
+ALTER TABLE users ALTER COLUMN password TYPE TEXT;
@@ -0,0 +1,2 @@
+-- The cleared bodies can't be restored; nothing to undo.
+SELECT 1;
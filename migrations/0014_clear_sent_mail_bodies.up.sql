@@ -0,0 +1,3 @@
+-- Sent and failed messages no longer keep their bodies, which hold live
+-- reset and verification links. Clear the ones queued before that.
+UPDATE mail_queue SET text_body = '', html_body = '' WHERE status IN ('sent', 'failed');
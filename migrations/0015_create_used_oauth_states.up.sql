@@ -0,0 +1,9 @@
+-- OAuth logins whose callback has been accepted, by the SHA-256 of their
+-- state, so a copy of the flow cookie can't complete the same login again.
+-- Rows are only needed until the flow would have expired anyway.
+CREATE TABLE used_oauth_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX used_oauth_states_expires_at_idx ON used_oauth_states (expires_at);
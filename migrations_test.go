@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	// Versions run 1..N in order with no gaps, and each can be reverted
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d_%s: got version %d, want %d", m.Version, m.Name, m.Version, i+1)
+		}
+		if m.Up == "" {
+			t.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrationFilePattern(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		ok   bool
+	}{
+		{"0001_create_users.up.sql", true},
+		{"0001_create_users.down.sql", true},
+		{"0012_add_account_suspension.up.sql", true},
+		{"0001_create_users.sql", false},
+		{"0001_Create_Users.up.sql", false},
+		{"create_users.up.sql", false},
+		{"0001_create-users.up.sql", false},
+		{"0001_create_users.up.sql.bak", false},
+	} {
+		if got := migrationFilePattern.MatchString(test.name); got != test.ok {
+			t.Errorf("%s: got match %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
@@ -1,13 +1,139 @@
 package main
 
+import "time"
+
 type User struct {
 	ID           int    `json:"id"`
 	MembershipID string `json:"membership_id"`
 	Username     string `json:"username"`
-	Password     string `json:"password"`
+	Email        string `json:"email,omitempty"`
+	// EmailVerifiedAt is when the user proved they receive mail at Email,
+	// nil while unverified.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	Password        string     `json:"password"`
+	// SessionEpoch invalidates every session started before it was last
+	// incremented.
+	SessionEpoch int `json:"-"`
+	// TOTPSecret is the base32 TOTP secret, set from the start of
+	// enrolment. TwoFactorEnabled is set once enrolment is confirmed.
+	TOTPSecret       string `json:"-"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+	// SuspendedAt is when an admin suspended the account, nil while it is
+	// active. A suspended account can't sign in.
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+}
+
+// Identity is an external login (e.g. a Google account) linked to a user.
+// Subject is the provider's stable identifier for the account.
+type Identity struct {
+	ID            int       `json:"id"`
+	UserID        int       `json:"-"`
+	Provider      string    `json:"provider"`
+	Subject       string    `json:"subject"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Passkey is a WebAuthn credential registered to a user. CredentialID and
+// PublicKey are the raw bytes from the authenticator.
+type Passkey struct {
+	ID              int        `json:"id"`
+	UserID          int        `json:"-"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `json:"credential_id"`
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	Transports      []string   `json:"transports"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `json:"-"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// SessionRecord is a server-side browser session. The browser holds a
+// random token; TokenHash is its SHA-256. UserID is 0 until the browser
+// signs in, and Data holds the encoded session values.
+type SessionRecord struct {
+	ID         int       `json:"id"`
+	TokenHash  string    `json:"-"`
+	UserID     int       `json:"-"`
+	Data       []byte    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// PersistentLogin is a "remember me" login, which signs its browser back in
+// after its session has expired. Like a session, only the token's hash is
+// stored.
+type PersistentLogin struct {
+	ID         int       `json:"id"`
+	TokenHash  string    `json:"-"`
+	UserID     int       `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// LoginThrottle counts recent failed sign-ins for an account or a client
+// address. No attempt is allowed before LockedUntil.
+type LoginThrottle struct {
+	Scope         string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// AuditEvent records a security-relevant action. UserID is the account it
+// concerns, if any, and Actor who or what caused it.
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	UserID    int       `json:"user_id,omitempty"`
+	Actor     string    `json:"actor"`
+	IPAddress string    `json:"ip_address"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type SignInCredentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	RememberMe bool   `json:"remember_me"`
+}
+
+// AccountToken is a single-use secret sent to a user, e.g. in a password
+// reset link. Only the SHA-256 hash of the secret is stored.
+type AccountToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	// Email is the address the token was sent to, for tokens that prove
+	// ownership of one.
+	Email      string
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// QueuedEmail is an email in the outgoing mail queue.
+type QueuedEmail struct {
+	ID            int
+	Email         Email
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        *time.Time
+	CreatedAt     time.Time
 }
@@ -1,175 +1,240 @@
 package main
 
 import (
-	"context"
-	cryptorand "crypto/rand"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
-var (
-	googleOauthConfig *oauth2.Config
-	oauthStateString  string
-)
-
-func init() {
-	// Load the .env file
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+// oauthHandler routes /auth/{provider}/login and /auth/{provider}/callback
+// to the provider registered under that name.
+func oauthHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/auth/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
 	}
 
-	googleOauthConfig = &oauth2.Config{
-		RedirectURL:  os.Getenv("GOOGLE_OAUTH_REDIRECT_URL"),
-		ClientID:     os.Getenv("GOOGLE_OAUTH_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint:     google.Endpoint,
+	provider, ok := oauthProviders[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
 
-	if googleOauthConfig.ClientID == "" {
-		log.Fatal("GOOGLE_OAUTH_CLIENT_ID environment variable is not set")
+	switch parts[1] {
+	case "login":
+		handleOAuthLogin(w, r, provider)
+	case "callback":
+		handleOAuthCallback(w, r, provider)
+	default:
+		http.NotFound(w, r)
 	}
-
-	oauthStateString = generateStateString()
-	log.Println("Google OAuth configuration initialized")
 }
 
-func generateStateString() string {
-	b := make([]byte, 32)
-	cryptorand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
-}
+func handleOAuthLogin(w http.ResponseWriter, r *http.Request, provider *oauthProvider) {
+	config, err := provider.oauth2Config()
+	if err != nil {
+		log.Printf("Error loading %s OAuth configuration: %v", provider.Name, err)
+		http.Error(w, "Sign-in provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	flow, err := beginOAuthFlow(w, r, provider.Name, r.URL.Query().Get("return_to"))
+	if err != nil {
+		log.Printf("Error starting OAuth flow: %v", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
 
-func handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
-	url := googleOauthConfig.AuthCodeURL(oauthStateString)
-	log.Printf("Redirecting to Google OAuth URL: %s", url)
+	url := config.AuthCodeURL(flow.State,
+		oauth2.S256ChallengeOption(flow.Verifier),
+		oauth2.SetAuthURLParam("nonce", flow.Nonce))
+	log.Printf("Redirecting to %s for OAuth login", provider.Name)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
-	log.Println("Received Google OAuth callback")
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider *oauthProvider) {
+	log.Printf("Received %s OAuth callback", provider.Name)
 
 	state := r.FormValue("state")
 	code := r.FormValue("code")
 
-	if state != oauthStateString {
-		log.Printf("Invalid OAuth state, expected '%s', got '%s'\n", oauthStateString, state)
+	flow, err := consumeOAuthFlow(w, r, provider.Name, state)
+	if err != nil {
+		log.Printf("Invalid OAuth state: %v", err)
 		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
 		return
 	}
 
-	content, err := getUserInfo(state, code)
+	config, err := provider.oauth2Config()
 	if err != nil {
-		log.Printf("Error getting user info: %v", err)
-		http.Error(w, "Error getting user info", http.StatusInternalServerError)
+		log.Printf("Error loading %s OAuth configuration: %v", provider.Name, err)
+		http.Error(w, "Sign-in provider unavailable", http.StatusBadGateway)
 		return
 	}
 
-	var userInfo struct {
-		Email string `json:"email"`
+	idToken, err := provider.oidc.exchangeIDToken(r.Context(), config, code, flow)
+	if err != nil {
+		log.Printf("Error verifying %s ID token: %v", provider.Name, err)
+		http.Error(w, "Error getting user info", http.StatusUnauthorized)
+		return
 	}
-	err = json.Unmarshal(content, &userInfo)
+
+	userInfo, err := provider.mapClaims(idToken)
 	if err != nil {
-		log.Printf("Error unmarshaling user info: %v", err)
-		http.Error(w, "Error processing user information", http.StatusInternalServerError)
+		log.Printf("Error reading %s ID token claims: %v", provider.Name, err)
+		http.Error(w, "Error getting user info", http.StatusUnauthorized)
 		return
 	}
 
-	if userInfo.Email == "" {
-		log.Println("Error: Email is empty")
-		http.Error(w, "Invalid email received from Google", http.StatusBadRequest)
+	if userInfo.Email == "" || userInfo.Subject == "" {
+		log.Println("Error: Email or subject is empty")
+		http.Error(w, fmt.Sprintf("Invalid email received from %s", provider.DisplayName), http.StatusBadRequest)
 		return
 	}
 
 	log.Printf("Received user info for email: %s", userInfo.Email)
 
-	membershipID := generateMembershipID()
+	identity := Identity{
+		Provider:      provider.Name,
+		Subject:       userInfo.Subject,
+		Email:         userInfo.Email,
+		EmailVerified: userInfo.EmailVerified,
+	}
 
-	// Check if the user already exists
-	existingUser, err := getUser(userInfo.Email)
+	// An account already linked to this identity just signs in
+	existingUser, err := userStore.GetUserByIdentity(identity.Provider, identity.Subject)
 	if err == nil {
-		log.Printf("User already exists with email: %s", userInfo.Email)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message":       "User already exists",
-			"membership_id": existingUser.MembershipID,
-			"email":         userInfo.Email,
-		})
+		signInIdentityUser(w, r, existingUser, identity, flow.ReturnTo)
+		return
+	}
+	if err != ErrUserNotFound {
+		log.Printf("Error looking up identity: %v", err)
+		http.Error(w, "Error getting user info", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate a 6-digit numerical password
-	password := generateSixDigitPassword()
-	hashedPassword, err := hashPassword(password)
-	if err != nil {
-		log.Printf("Error hashing password: %v", err)
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
+	// An existing account with the same email must prove ownership before
+	// the identity is linked to it
+	existingUser, err = userStore.GetUser(userInfo.Email)
+	if err == nil {
+		if !identity.EmailVerified {
+			log.Printf("Refusing to link unverified %s email: %s", provider.Name, userInfo.Email)
+			http.Error(w, fmt.Sprintf("Your %s email address is not verified", provider.DisplayName), http.StatusForbidden)
+			return
+		}
+		if createdByGoogle(existingUser, provider, identity) {
+			identity.UserID = existingUser.ID
+			err = userStore.CreateIdentity(&identity)
+			if err != nil {
+				log.Printf("Error linking %s identity: %v", provider.Name, err)
+				http.Error(w, "Error linking account", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Linked %s identity to user %s, which it created before identities were recorded", provider.Name, existingUser.Username)
+			signInIdentityUser(w, r, existingUser, identity, flow.ReturnTo)
+			return
+		}
+		log.Printf("%s login matches existing account %s, asking for password", provider.DisplayName, existingUser.Username)
+		err = savePendingLink(w, r, existingUser, identity)
+		if err != nil {
+			http.Error(w, "Error creating session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/link", http.StatusSeeOther)
+		return
+	}
+	if err != ErrUserNotFound {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "Error getting user info", http.StatusInternalServerError)
+		return
+	}
+
+	// The email becomes the new account's username, so only take it from
+	// the provider once the provider has verified it
+	if !identity.EmailVerified {
+		log.Printf("Refusing to create account for unverified %s email: %s", provider.Name, userInfo.Email)
+		http.Error(w, fmt.Sprintf("Your %s email address is not verified", provider.DisplayName), http.StatusForbidden)
 		return
 	}
 
 	// User doesn't exist, create a new one
-	err = createUser(membershipID, userInfo.Email, hashedPassword)
+	// The provider has verified the email, so the account starts verified.
+	// It has no password until the user sets one.
+	now := time.Now()
+	user := User{MembershipID: generateMembershipID(), Username: userInfo.Email, Email: userInfo.Email, EmailVerifiedAt: &now}
+	err = userStore.CreateUser(&user)
 	if err != nil {
 		log.Printf("Error creating user: %v", err)
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("User created successfully via Google OAuth: %s", userInfo.Email)
+	identity.UserID = user.ID
+	err = userStore.CreateIdentity(&identity)
+	if err != nil {
+		log.Printf("Error linking %s identity: %v", provider.Name, err)
+		userStore.DeleteUser(user.ID)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User created successfully via %s OAuth: %s", provider.Name, userInfo.Email)
 
-	log.Printf("User created successfully via Google OAuth: %s", userInfo.Email)
-	
-	// Create a session for the user
-	session, _ := store.Get(r, "session-name")
-	session.Values["user_id"] = membershipID
-	session.Values["username"] = userInfo.Email
-	session.Save(r, w)
+	err = startSession(w, r, user)
+	if err != nil {
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
 
-	// Redirect to the welcome page
-	http.Redirect(w, r, "/welcome", http.StatusSeeOther)
+	// Redirect to where the login started, the welcome page by default
+	http.Redirect(w, r, flow.ReturnTo, http.StatusSeeOther)
 }
 
-func getUserInfo(state string, code string) ([]byte, error) {
-	if state != oauthStateString {
-		return nil, fmt.Errorf("invalid oauth state")
+// signInIdentityUser signs in user, to which identity is linked, and sends
+// the browser on to returnTo.
+func signInIdentityUser(w http.ResponseWriter, r *http.Request, user User, identity Identity, returnTo string) {
+	verifyIdentityEmail(&user, identity)
+	if accountSuspended(user) {
+		log.Printf("Refusing sign-in of suspended user %s", user.Username)
+		http.Error(w, suspendedMessage, http.StatusForbidden)
+		return
 	}
-
-	token, err := googleOauthConfig.Exchange(context.Background(), code)
-	if err != nil {
-		return nil, fmt.Errorf("code exchange failed: %s", err.Error())
+	if !canSignIn(user) {
+		http.Error(w, "Please verify your email address before signing in", http.StatusForbidden)
+		return
 	}
 
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	log.Printf("Signing in linked user: %s", user.Username)
+	needsSecondFactor, err := beginSignIn(w, r, user, returnTo, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
 	}
-	defer response.Body.Close()
-
-	contents, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed reading response body: %s", err.Error())
+	if needsSecondFactor {
+		http.Redirect(w, r, "/signin/2fa", http.StatusSeeOther)
+		return
 	}
-
-	return contents, nil
-}
-
-func generateSixDigitPassword() string {
-	return fmt.Sprintf("%06d", randGen.Intn(1000000))
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
 }
 
-func generateRandomPassword() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
+// createdByGoogle reports whether user is an account earlier versions
+// created on a Google sign-in, which identity, with its verified email,
+// comes back to. Those versions used the email as the username and
+// recorded no identity, so they'd otherwise be asked for a password nobody
+// was shown.
+func createdByGoogle(user User, provider *oauthProvider, identity Identity) bool {
+	if provider.Name != "google" || !identity.EmailVerified || !strings.EqualFold(user.Username, identity.Email) {
+		return false
+	}
+	identities, err := userStore.ListIdentities(user.ID)
+	if err != nil {
+		log.Printf("Error listing identities of user %s: %v", user.Username, err)
+		return false
+	}
+	return len(identities) == 0
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// useTestProvider registers issuer as the google provider for the length
+// of the test.
+func useTestProvider(t *testing.T, issuer *testIssuer) *rsa.PrivateKey {
+	t.Helper()
+	err := registerProvider(providerConfig{
+		Name:        "google",
+		DisplayName: "Google",
+		Issuer:      issuer.server.URL,
+		ClientID:    "client-id",
+		RedirectURL: "http://example.com/auth/google/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		delete(oauthProviders, "google")
+		oauthProviderOrder = nil
+	})
+	return issuer.newKey(t, "key-1", true)
+}
+
+// startOAuthLogin starts a login and returns the flow cookie and the
+// state and nonce sent to the provider.
+func startOAuthLogin(t *testing.T) (*http.Cookie, string, string) {
+	t.Helper()
+	w := serve(oauthHandler, http.MethodGet, "/auth/google/login", "")
+	location, err := url.Parse(w.Header().Get("Location"))
+	cookie := responseCookie(w, oauthFlowCookie)
+	if w.Code != http.StatusTemporaryRedirect || err != nil || cookie == nil {
+		t.Fatalf("login: got %d %s", w.Code, w.Body)
+	}
+	return cookie, location.Query().Get("state"), location.Query().Get("nonce")
+}
+
+// completeOAuthLogin has the provider answer with an ID token of claims,
+// changed by edits, and calls the callback with the flow cookie and state.
+func completeOAuthLogin(t *testing.T, issuer *testIssuer, key *rsa.PrivateKey, cookie *http.Cookie, state, nonce string, edits map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	claims := issuer.claims(edits)
+	claims["nonce"] = nonce
+	idToken := issuer.sign(t, key, "key-1", claims)
+	issuer.mu.Lock()
+	issuer.idToken = idToken
+	issuer.mu.Unlock()
+	return serve(oauthHandler, http.MethodGet, "/auth/google/callback?code=code-1&state="+url.QueryEscape(state), "", cookie)
+}
+
+func TestOAuthCallbackLinksPreSeriesGoogleAccount(t *testing.T) {
+	setupTestServer(t)
+	issuer := newTestIssuer(t)
+	key := useTestProvider(t, issuer)
+	hash, err := hashPassword("Correct-Horse-77-battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		create func() User
+		linked bool
+	}{
+		{"created by a Google sign-in", func() User { return createLegacyUser(t, "alice@example.com", hash) }, true},
+		{"username in another case", func() User { return createLegacyUser(t, "Alice@Example.com", hash) }, true},
+		{"username isn't the email", func() User { return createTestUser(t, "alice", "Correct-Horse-77-battery") }, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			userStore = newMemoryStore()
+			user := test.create()
+
+			cookie, state, nonce := startOAuthLogin(t)
+			w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, nil)
+			identities, _ := userStore.ListIdentities(user.ID)
+			if !test.linked {
+				if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/link" || len(identities) != 0 {
+					t.Fatalf("got %d to %s with %d identities, want a password confirmation", w.Code, w.Header().Get("Location"), len(identities))
+				}
+				return
+			}
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/welcome" || responseCookie(w, sessionCookieName) == nil {
+				t.Fatalf("got %d to %s, want a sign-in", w.Code, w.Header().Get("Location"))
+			}
+			if len(identities) != 1 || identities[0].Subject != "subject-1" {
+				t.Fatalf("got identities %+v", identities)
+			}
+		})
+	}
+
+	// Once an account has an identity, another Google account with its
+	// email has to confirm the password
+	userStore = newMemoryStore()
+	user := createLegacyUser(t, "alice@example.com", hash)
+	cookie, state, nonce := startOAuthLogin(t)
+	completeOAuthLogin(t, issuer, key, cookie, state, nonce, nil)
+	cookie, state, nonce = startOAuthLogin(t)
+	w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, map[string]interface{}{"sub": "subject-2"})
+	if identities, _ := userStore.ListIdentities(user.ID); w.Header().Get("Location") != "/link" || len(identities) != 1 {
+		t.Fatalf("second Google account: got %d to %s with %d identities", w.Code, w.Header().Get("Location"), len(identities))
+	}
+
+	// Unverified emails aren't linked
+	userStore = newMemoryStore()
+	createLegacyUser(t, "alice@example.com", hash)
+	cookie, state, nonce = startOAuthLogin(t)
+	if w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, map[string]interface{}{"email_verified": false}); w.Code != http.StatusForbidden {
+		t.Fatalf("unverified email: got %d", w.Code)
+	}
+}
+
+func TestOAuthCallbackIsSingleUse(t *testing.T) {
+	setupTestServer(t)
+	issuer := newTestIssuer(t)
+	key := useTestProvider(t, issuer)
+
+	cookie, state, nonce := startOAuthLogin(t)
+	if w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/welcome" {
+		t.Fatalf("first callback: got %d %s", w.Code, w.Body)
+	}
+	// The browser drops the cookie, but a copy of it comes back with the
+	// same state
+	if w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback: got %d, want 400", w.Code)
+	}
+
+	// Another login's state is still accepted
+	cookie, state, nonce = startOAuthLogin(t)
+	if w := completeOAuthLogin(t, issuer, key, cookie, state, nonce, nil); w.Code != http.StatusSeeOther {
+		t.Fatalf("new login: got %d %s", w.Code, w.Body)
+	}
+}
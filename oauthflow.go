@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// oauthFlowTTL is how long a user has to complete a login at the provider.
+const oauthFlowTTL = 10 * time.Minute
+
+const oauthFlowCookie = "oauth-flow"
+
+var (
+	errNoOAuthFlow      = errors.New("no oauth login in progress")
+	errOAuthFlowExpired = errors.New("oauth login expired")
+	errOAuthStateMatch  = errors.New("oauth state mismatch")
+	errOAuthProvider    = errors.New("oauth login was started with another provider")
+	errOAuthFlowUsed    = errors.New("oauth login already completed")
+)
+
+// oauthFlow is the per-attempt secret material of an authorization code
+// login. It lives in a short-lived signed cookie bound to the browser that
+// started the login, and is single-use: the callback deletes the cookie and
+// records the state on the server, so a copy of the cookie is refused too.
+type oauthFlow struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	ReturnTo string
+}
+
+// oauthFlowOptions returns the flow cookie's settings: the configured ones
+// (see initSessionStores, which keeps SameSite at most lax so the cookie
+// survives the top-level redirect back from the provider), limited to
+// /auth/.
+func oauthFlowOptions(maxAge int) *sessions.Options {
+	options := *cookieStore.Options
+	options.Path = "/auth/"
+	options.MaxAge = maxAge
+	return &options
+}
+
+// beginOAuthFlow generates a fresh state, nonce and PKCE verifier for a
+// login with provider and stores them in the flow cookie.
+func beginOAuthFlow(w http.ResponseWriter, r *http.Request, provider, returnTo string) (oauthFlow, error) {
+	flow := oauthFlow{
+		Provider: provider,
+		State:    generateRandomToken(32),
+		Nonce:    generateRandomToken(32),
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: safeReturnURL(returnTo),
+	}
+
+	session, _ := cookieStore.New(r, oauthFlowCookie)
+	session.Options = oauthFlowOptions(int(oauthFlowTTL.Seconds()))
+	session.Values["provider"] = flow.Provider
+	session.Values["state"] = flow.State
+	session.Values["nonce"] = flow.Nonce
+	session.Values["verifier"] = flow.Verifier
+	session.Values["return_to"] = flow.ReturnTo
+	session.Values["expires"] = time.Now().Add(oauthFlowTTL).Unix()
+	return flow, session.Save(r, w)
+}
+
+// consumeOAuthFlow loads the flow started by this browser, deletes the
+// cookie, checks the flow against the provider whose callback was hit and
+// the state that provider returned, and marks the state used.
+func consumeOAuthFlow(w http.ResponseWriter, r *http.Request, provider, state string) (oauthFlow, error) {
+	session, err := cookieStore.Get(r, oauthFlowCookie)
+	if err != nil || session.IsNew {
+		return oauthFlow{}, errNoOAuthFlow
+	}
+
+	var flow oauthFlow
+	flow.Provider, _ = session.Values["provider"].(string)
+	flow.State, _ = session.Values["state"].(string)
+	flow.Nonce, _ = session.Values["nonce"].(string)
+	flow.Verifier, _ = session.Values["verifier"].(string)
+	flow.ReturnTo, _ = session.Values["return_to"].(string)
+	expires, _ := session.Values["expires"].(int64)
+
+	session.Options = oauthFlowOptions(-1)
+	session.Values = map[interface{}]interface{}{}
+	err = session.Save(r, w)
+	if err != nil {
+		return oauthFlow{}, err
+	}
+
+	if flow.State == "" {
+		return oauthFlow{}, errNoOAuthFlow
+	}
+	if time.Now().Unix() > expires {
+		return oauthFlow{}, errOAuthFlowExpired
+	}
+	if flow.Provider != provider {
+		return oauthFlow{}, errOAuthProvider
+	}
+	if subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return oauthFlow{}, errOAuthStateMatch
+	}
+	err = userStore.UseOAuthState(hashToken(flow.State), time.Unix(expires, 0))
+	if err == ErrTokenInvalid {
+		return oauthFlow{}, errOAuthFlowUsed
+	}
+	if err != nil {
+		return oauthFlow{}, err
+	}
+
+	return flow, nil
+}
+
+// safeReturnURL only accepts local absolute paths so the post-login redirect
+// can't be used to send users to another site. Anything else falls back to
+// the welcome page.
+func safeReturnURL(raw string) string {
+	const fallback = "/welcome"
+	if raw == "" || !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.ContainsAny(raw, "\\\r\n") {
+		return fallback
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return fallback
+	}
+	return u.RequestURI()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var errNonceMismatch = errors.New("id token nonce mismatch")
+
+// oidcProvider verifies ID tokens from one issuer. Discovery runs on first
+// use rather than at startup so an unreachable issuer doesn't stop the
+// server; once it succeeds the provider and its JWKS are cached, and keys
+// are refetched whenever a token is signed with an unknown key ID.
+type oidcProvider struct {
+	issuer   string
+	clientID string
+	// client is used for discovery and JWKS requests. Tests point it, and
+	// issuer, at a local stand-in.
+	client *http.Client
+	// now is the clock used for expiry checks.
+	now func() time.Time
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCProvider(issuer, clientID string, client *http.Client) *oidcProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &oidcProvider{
+		issuer:   issuer,
+		clientID: clientID,
+		client:   client,
+		now:      time.Now,
+	}
+}
+
+func (p *oidcProvider) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, p.client)
+}
+
+// discover fetches the issuer's discovery document the first time it's
+// needed and returns the cached result afterwards.
+func (p *oidcProvider) discover() (*oidc.Provider, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, p.verifier, nil
+	}
+
+	// The key set keeps using this context, and the client in it, for later
+	// refreshes, so it must outlive the request that triggered discovery.
+	provider, err := oidc.NewProvider(p.context(context.Background()), p.issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error discovering %s: %v", p.issuer, err)
+	}
+
+	p.provider = provider
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.clientID, Now: p.now})
+	return p.provider, p.verifier, nil
+}
+
+// endpoint returns the issuer's authorization and token endpoints.
+func (p *oidcProvider) endpoint() (oauth2.Endpoint, error) {
+	provider, _, err := p.discover()
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+	return provider.Endpoint(), nil
+}
+
+// verify checks rawIDToken's signature, issuer, audience and expiry, then
+// that it carries the nonce sent with the authorization request.
+func (p *oidcProvider) verify(ctx context.Context, rawIDToken, nonce string) (*oidc.IDToken, error) {
+	_, verifier, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := verifier.Verify(p.context(ctx), rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying id token: %v", err)
+	}
+	if nonce == "" || idToken.Nonce != nonce {
+		return nil, errNonceMismatch
+	}
+	return idToken, nil
+}
+
+// exchangeIDToken redeems an authorization code and returns the verified ID
+// token that came with the access token.
+func (p *oidcProvider) exchangeIDToken(ctx context.Context, config *oauth2.Config, code string, flow oauthFlow) (*oidc.IDToken, error) {
+	token, err := config.Exchange(p.context(ctx), code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.verify(ctx, rawIDToken, flow.Nonce)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a local stand-in for an OpenID provider: it serves a
+// discovery document and a JWKS, and signs ID tokens with RS256.
+type testIssuer struct {
+	server *httptest.Server
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey // published signing keys by key ID
+	// idToken is what the token endpoint returns for any code.
+	idToken string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		var keys []map[string]string
+		for kid, key := range issuer.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken,
+		})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// newKey makes a signing key. Published keys appear in the JWKS.
+func (i *testIssuer) newKey(t *testing.T, kid string, publish bool) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publish {
+		i.mu.Lock()
+		i.keys[kid] = key
+		i.mu.Unlock()
+	}
+	return key
+}
+
+// rotate replaces the published keys with the key kid.
+func (i *testIssuer) rotate(t *testing.T, kid string) *rsa.PrivateKey {
+	i.mu.Lock()
+	i.keys = make(map[string]*rsa.PrivateKey)
+	i.mu.Unlock()
+	return i.newKey(t, kid, true)
+}
+
+// sign makes an RS256 ID token with claims.
+func (i *testIssuer) sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims returns valid claims for client-id with nonce, changed by edits.
+func (i *testIssuer) claims(edits map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            i.server.URL,
+		"aud":            "client-id",
+		"sub":            "subject-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          "nonce-1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+	for name, value := range edits {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := issuer.newKey(t, "key-1", true)
+	unpublished := issuer.newKey(t, "key-x", false)
+	provider := newOIDCProvider(issuer.server.URL, "client-id", issuer.server.Client())
+
+	for _, test := range []struct {
+		name  string
+		key   *rsa.PrivateKey
+		kid   string
+		edits map[string]interface{}
+		nonce string
+		ok    bool
+	}{
+		{name: "valid", ok: true},
+		{name: "wrong issuer", edits: map[string]interface{}{"iss": "https://evil.example.com"}},
+		{name: "wrong audience", edits: map[string]interface{}{"aud": "other-client"}},
+		{name: "expired", edits: map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{name: "no expiry", edits: map[string]interface{}{"exp": nil}},
+		{name: "wrong nonce", nonce: "nonce-2"},
+		{name: "no nonce", edits: map[string]interface{}{"nonce": nil}},
+		{name: "unknown key", key: unpublished, kid: "key-x"},
+		{name: "key ID of another key", key: unpublished, kid: "key-1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			signingKey, kid, nonce := key, "key-1", "nonce-1"
+			if test.key != nil {
+				signingKey, kid = test.key, test.kid
+			}
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			_, err := provider.verify(context.Background(), issuer.sign(t, signingKey, kid, issuer.claims(test.edits)), nonce)
+			if test.ok && err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("verify accepted the token")
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	oldKey := issuer.newKey(t, "key-1", true)
+	provider := newOIDCProvider(issuer.server.URL, "client-id", issuer.server.Client())
+
+	// The first token caches the JWKS with the old key
+	_, err := provider.verify(context.Background(), issuer.sign(t, oldKey, "key-1", issuer.claims(nil)), "nonce-1")
+	if err != nil {
+		t.Fatalf("verify with the old key: %v", err)
+	}
+
+	// A token with a new key ID makes the provider fetch the keys again
+	newKey := issuer.rotate(t, "key-2")
+	_, err = provider.verify(context.Background(), issuer.sign(t, newKey, "key-2", issuer.claims(nil)), "nonce-1")
+	if err != nil {
+		t.Fatalf("verify with the rotated key: %v", err)
+	}
+
+	// The old key is no longer published
+	_, err = provider.verify(context.Background(), issuer.sign(t, oldKey, "key-1", issuer.claims(nil)), "nonce-1")
+	if err == nil {
+		t.Fatal("verify accepted a token signed with the retired key")
+	}
+}
+
+func TestMapClaimsEmailVerified(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := issuer.newKey(t, "key-1", true)
+	provider := newOIDCProvider(issuer.server.URL, "client-id", issuer.server.Client())
+
+	for _, test := range []struct {
+		name     string
+		mapping  claimMapping
+		edits    map[string]interface{}
+		verified bool
+	}{
+		{name: "verified", verified: true},
+		{name: "unverified", edits: map[string]interface{}{"email_verified": false}},
+		{name: "string flag", edits: map[string]interface{}{"email_verified": "true"}, verified: true},
+		{name: "missing flag", edits: map[string]interface{}{"email_verified": nil}},
+		{name: "custom claim", mapping: claimMapping{EmailVerified: "verified"}, edits: map[string]interface{}{"email_verified": false, "verified": true}, verified: true},
+		{name: "trusted email", mapping: claimMapping{TrustEmail: true}, edits: map[string]interface{}{"email_verified": nil}, verified: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			idToken, err := provider.verify(context.Background(), issuer.sign(t, key, "key-1", issuer.claims(test.edits)), "nonce-1")
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			claims, err := (&oauthProvider{claims: test.mapping}).mapClaims(idToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "subject-1" || claims.Email != "alice@example.com" || claims.EmailVerified != test.verified {
+				t.Fatalf("got %+v, want email verified %v", claims, test.verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// passkeyCeremonyTimeout is how long the browser and the user have to
+// finish a registration or sign-in once it has begun.
+const passkeyCeremonyTimeout = 5 * time.Minute
+
+const maxPasskeyNameLength = 100
+
+var webAuthn *webauthn.WebAuthn
+
+// initWebAuthn configures the WebAuthn relying party. By default it is
+// derived from PUBLIC_BASE_URL; WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and
+// WEBAUTHN_ORIGINS (comma-separated) override it.
+func initWebAuthn() error {
+	base, err := url.Parse(publicURL("/"))
+	if err != nil {
+		return fmt.Errorf("invalid PUBLIC_BASE_URL: %v", err)
+	}
+
+	origins := splitList(os.Getenv("WEBAUTHN_ORIGINS"))
+	if len(origins) == 0 {
+		origins = []string{base.Scheme + "://" + base.Host}
+	}
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    passkeyCeremonyTimeout,
+		TimeoutUVD: passkeyCeremonyTimeout,
+	}
+
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          firstNonEmpty(os.Getenv("WEBAUTHN_RP_ID"), base.Hostname()),
+		RPDisplayName: firstNonEmpty(os.Getenv("WEBAUTHN_RP_NAME"), "Sign-Up Flow"),
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error configuring WebAuthn: %v", err)
+	}
+	log.Printf("WebAuthn relying party %s for %s", webAuthn.Config.RPID, strings.Join(origins, ", "))
+	return nil
+}
+
+// webAuthnUser adapts a user and their passkeys to webauthn.User. The user
+// handle given to authenticators is the membership ID, which is random and
+// never changes.
+type webAuthnUser struct {
+	user     User
+	passkeys []Passkey
+}
+
+func loadWebAuthnUser(user User) (webAuthnUser, error) {
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil {
+		return webAuthnUser{}, fmt.Errorf("error retrieving passkeys: %v", err)
+	}
+	return webAuthnUser{user: user, passkeys: passkeys}, nil
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.user.MembershipID)
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+// WebAuthnIcon is deprecated in the spec; browsers ignore it.
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, passkey := range u.passkeys {
+		transports := make([]protocol.AuthenticatorTransport, len(passkey.Transports))
+		for j, transport := range passkey.Transports {
+			transports[j] = protocol.AuthenticatorTransport(transport)
+		}
+		credentials[i] = webauthn.Credential{
+			ID:              passkey.CredentialID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+// saveCeremony keeps the challenge of a registration or sign-in in the
+// session until it is finished.
+func saveCeremony(w http.ResponseWriter, r *http.Request, key string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	session, _ := store.Get(r, sessionCookieName)
+	session.Values[key] = string(encoded)
+	return session.Save(r, w)
+}
+
+// takeCeremony returns and clears the ceremony saved under key, so each
+// challenge can be answered once.
+func takeCeremony(w http.ResponseWriter, r *http.Request, key string) (webauthn.SessionData, bool) {
+	session, _ := store.Get(r, sessionCookieName)
+	encoded, _ := session.Values[key].(string)
+	if encoded == "" {
+		return webauthn.SessionData{}, false
+	}
+	delete(session.Values, key)
+	session.Save(r, w)
+
+	var data webauthn.SessionData
+	err := json.Unmarshal([]byte(encoded), &data)
+	return data, err == nil
+}
+
+// webAuthnErrorDetail returns the library's debugging detail for err, which
+// says why a ceremony was rejected.
+func webAuthnErrorDetail(err error) string {
+	if protocolErr, ok := err.(*protocol.Error); ok && protocolErr.DevInfo != "" {
+		return protocolErr.Details + ": " + protocolErr.DevInfo
+	}
+	return err.Error()
+}
+
+// beginPasskeyRegistrationHandler returns the options for
+// navigator.credentials.create(). Passkeys are created as discoverable
+// credentials so they can be used without entering a username.
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	waUser, err := loadWebAuthnUser(user)
+	if err != nil {
+		log.Printf("Error loading passkeys: %v", err)
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	// Don't let the same authenticator register twice
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range waUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, data, err := webAuthn.BeginRegistration(waUser,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		log.Printf("Error beginning passkey registration: %v", err)
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	err = saveCeremony(w, r, "webauthn_registration", data)
+	if err != nil {
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// finishPasskeyRegistrationHandler verifies the authenticator's response
+// and stores the new passkey.
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyNameLength {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+
+	data, ok := takeCeremony(w, r, "webauthn_registration")
+	if !ok {
+		http.Error(w, "No passkey registration in progress", http.StatusBadRequest)
+		return
+	}
+
+	response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body.Credential))
+	if err != nil {
+		log.Printf("Invalid passkey registration response: %s", webAuthnErrorDetail(err))
+		http.Error(w, "Invalid passkey registration response", http.StatusBadRequest)
+		return
+	}
+
+	waUser, err := loadWebAuthnUser(user)
+	if err != nil {
+		log.Printf("Error loading passkeys: %v", err)
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		return
+	}
+	credential, err := webAuthn.CreateCredential(waUser, data, response)
+	if err != nil {
+		log.Printf("Passkey registration for %s rejected: %s", user.Username, webAuthnErrorDetail(err))
+		http.Error(w, "Passkey registration failed", http.StatusBadRequest)
+		return
+	}
+
+	passkey := Passkey{
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	for _, transport := range credential.Transport {
+		passkey.Transports = append(passkey.Transports, string(transport))
+	}
+
+	err = userStore.CreatePasskey(&passkey)
+	if err == ErrPasskeyExists {
+		http.Error(w, "This passkey is already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving passkey: %v", err)
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Registered passkey %d for user %s", passkey.ID, user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+// passkeysHandler lists the passkeys of the signed-in user.
+func passkeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving passkeys", http.StatusInternalServerError)
+		return
+	}
+	if passkeys == nil {
+		passkeys = []Passkey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// passkeysPageHandler shows the passkey management page.
+func passkeysPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, r, "templates/passkeys.html", struct{ Passkeys []Passkey }{Passkeys: passkeys})
+}
+
+func renamePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxPasskeyNameLength {
+		http.Error(w, "Name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	err = userStore.RenamePasskey(user.ID, body.ID, name)
+	if err == ErrPasskeyNotFound {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error renaming passkey: %v", err)
+		http.Error(w, "Error renaming passkey", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Passkey renamed"})
+}
+
+// deletePasskeyHandler removes a passkey. Like unlinking an identity, the
+// last way of signing in can't be removed.
+func deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	methods, err := signInMethods(user)
+	if err != nil {
+		log.Printf("Error counting sign-in methods: %v", err)
+		http.Error(w, "Error deleting passkey", http.StatusInternalServerError)
+		return
+	}
+	if methods <= 1 {
+		http.Error(w, "Cannot delete your only sign-in method", http.StatusConflict)
+		return
+	}
+
+	err = userStore.DeletePasskey(user.ID, body.ID)
+	if err == ErrPasskeyNotFound {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting passkey: %v", err)
+		http.Error(w, "Error deleting passkey", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted passkey %d of user %s", body.ID, user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Passkey deleted"})
+}
+
+// beginPasskeySignInHandler returns the options for
+// navigator.credentials.get(). No username is needed: the authenticator
+// offers the passkeys it has for this site and tells us whose it is.
+func beginPasskeySignInHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	options, data, err := webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Printf("Error beginning passkey sign-in: %v", err)
+		http.Error(w, "Error starting passkey sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	err = saveCeremony(w, r, "webauthn_login", data)
+	if err != nil {
+		http.Error(w, "Error starting passkey sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// finishPasskeySignInHandler verifies a passkey assertion and signs its
+// owner in. A passkey with user verification is already two factors, so
+// no TOTP code is asked for.
+func finishPasskeySignInHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, ok := takeCeremony(w, r, "webauthn_login")
+	if !ok {
+		http.Error(w, "No passkey sign-in in progress", http.StatusBadRequest)
+		return
+	}
+
+	response, err := protocol.ParseCredentialRequestResponseBody(r.Body)
+	if err != nil {
+		log.Printf("Invalid passkey sign-in response: %s", webAuthnErrorDetail(err))
+		http.Error(w, "Invalid passkey response", http.StatusBadRequest)
+		return
+	}
+
+	var passkey Passkey
+	var waUser webAuthnUser
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		passkey, err = userStore.GetPasskeyByCredentialID(rawID)
+		if err != nil {
+			return nil, err
+		}
+		user, err := userStore.GetUserByID(passkey.UserID)
+		if err != nil {
+			return nil, err
+		}
+		waUser, err = loadWebAuthnUser(user)
+		return waUser, err
+	}
+
+	credential, err := webAuthn.ValidateDiscoverableLogin(findUser, data, response)
+	if err != nil {
+		log.Printf("Passkey sign-in rejected: %s", webAuthnErrorDetail(err))
+		http.Error(w, "Passkey sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	user := waUser.user
+
+	// A signature counter that went backwards means the private key may
+	// have been copied off the authenticator.
+	if credential.Authenticator.CloneWarning {
+		log.Printf("Passkey %d of user %s sent signature counter %d after %d; refusing sign-in", passkey.ID, user.Username, response.Response.AuthenticatorData.Counter, passkey.SignCount)
+		http.Error(w, "Passkey sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	err = userStore.UpdatePasskeyUsage(passkey.ID, credential.Authenticator.SignCount, credential.Flags.BackupState)
+	if err != nil {
+		log.Printf("Error updating passkey %d: %v", passkey.ID, err)
+	}
+
+	if accountSuspended(user) {
+		log.Printf("Refusing sign-in of suspended user %s", user.Username)
+		http.Error(w, suspendedMessage, http.StatusForbidden)
+		return
+	}
+	if !canSignIn(user) {
+		http.Error(w, "Please verify your email address before signing in", http.StatusForbidden)
+		return
+	}
+
+	err = startSession(w, r, user)
+	if err != nil {
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s signed in with passkey %d", user.Username, passkey.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Sign in successful",
+		"redirect": "/welcome",
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+const testOrigin = "http://localhost:8080"
+
+// softAuthenticator is a passkey authenticator in software: one P-256
+// credential, "none" attestation, and user presence and verification on
+// every use.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedCreds = 0x40
+)
+
+// authenticatorData builds the authenticator data for the relying party
+// localhost, with the attested credential when registering.
+func (a *softAuthenticator) authenticatorData(t *testing.T, register bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(flagUserPresent | flagUserVerified)
+	if register {
+		flags |= flagAttestedCreds
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !register {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, publicKey...)
+}
+
+func clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+// register answers navigator.credentials.create() options.
+func (a *softAuthenticator) register(t *testing.T, options []byte) map[string]interface{} {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &creation); err != nil {
+		t.Fatal(err)
+	}
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData("webauthn.create", creation.PublicKey.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+	}
+}
+
+// assert answers navigator.credentials.get() options for the user with
+// userHandle, counting the use.
+func (a *softAuthenticator) assert(t *testing.T, options []byte, userHandle string) map[string]interface{} {
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		t.Fatal(err)
+	}
+
+	a.signCount++
+	authData := a.authenticatorData(t, false)
+	client := clientData("webauthn.get", assertion.PublicKey.Challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString([]byte(userHandle)),
+		},
+	}
+}
+
+// passkeySignIn runs a passkey sign-in from a new browser and returns the
+// finish response.
+func passkeySignIn(t *testing.T, authenticator *softAuthenticator, user User) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(beginPasskeySignInHandler, http.MethodPost, "/signin/passkey/begin", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin sign-in: got %d %s", w.Code, w.Body)
+	}
+	ceremony := responseCookie(w, sessionCookieName)
+
+	response, _ := json.Marshal(authenticator.assert(t, w.Body.Bytes(), user.MembershipID))
+	return serve(finishPasskeySignInHandler, http.MethodPost, "/signin/passkey/finish", string(response), ceremony)
+}
+
+func TestPasskeyRegistrationAndSignIn(t *testing.T) {
+	setupTestServer(t)
+	t.Setenv("PUBLIC_BASE_URL", testOrigin)
+	if err := initWebAuthn(); err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	authenticator := newSoftAuthenticator(t)
+
+	// Register a passkey while signed in with the password
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"Correct-Horse-77-battery"}`)
+	cookie := responseCookie(w, sessionCookieName)
+	w = serve(beginPasskeyRegistrationHandler, http.MethodPost, "/account/passkeys/register/begin", "", cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin registration: got %d %s", w.Code, w.Body)
+	}
+	if updated := responseCookie(w, sessionCookieName); updated != nil {
+		cookie = updated
+	}
+	body, _ := json.Marshal(map[string]interface{}{"name": "Laptop", "credential": authenticator.register(t, w.Body.Bytes())})
+	w = serve(finishPasskeyRegistrationHandler, http.MethodPost, "/account/passkeys/register/finish", string(body), cookie)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("finish registration: got %d %s", w.Code, w.Body)
+	}
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil || len(passkeys) != 1 || passkeys[0].Name != "Laptop" {
+		t.Fatalf("got passkeys %+v, err %v", passkeys, err)
+	}
+
+	// Sign in with it from another browser, without a username
+	w = passkeySignIn(t, authenticator, user)
+	if w.Code != http.StatusOK {
+		t.Fatalf("passkey sign-in: got %d %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(responseCookie(w, sessionCookieName))
+	if signedIn, err := currentUser(r); err != nil || signedIn.ID != user.ID {
+		t.Fatalf("passkey sign-in: got user %q, err %v", signedIn.Username, err)
+	}
+	passkey, err := userStore.GetPasskeyByCredentialID(authenticator.credentialID)
+	if err != nil || passkey.SignCount != 1 || passkey.LastUsedAt == nil {
+		t.Fatalf("passkey usage not recorded: %+v, err %v", passkey, err)
+	}
+
+	// A counter that doesn't go up means a cloned key
+	authenticator.signCount = 0
+	w = passkeySignIn(t, authenticator, user)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("sign-in with a stale counter: got %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a password reset link stays valid.
+const passwordResetTTL = time.Hour
+
+// passwordResetInterval is the minimum time between two reset emails to the
+// same account, so the form can't be used to flood someone's inbox.
+const passwordResetInterval = 2 * time.Minute
+
+// noPasswordMessage answers a password sign-in to an account that has no
+// password, such as one created by signing in with a provider.
+const noPasswordMessage = "This account has no password. Sign in with your linked provider or passkey; you can then set a password from your account page."
+
+// forgotPasswordHandler shows the reset request form (GET) and mails a reset
+// link (POST). The response is the same whether or not an account matched,
+// so it can't be used to find out who has an account.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "templates/forgot.html", nil)
+	case http.MethodPost:
+		var body struct {
+			Email string `json:"email"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+
+		// Look the account up and send the mail in the background so the
+		// response time doesn't depend on whether the account exists.
+		go sendPasswordReset(body.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If an account exists for that email, a password reset link has been sent",
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sendPasswordReset(email string) {
+	user, err := userStore.GetUser(email)
+	if err == ErrUserNotFound || (err == nil && user.Email == "") {
+		log.Printf("Password reset requested for unknown email: %s", email)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user for password reset: %v", err)
+		return
+	}
+
+	// The response doesn't say whether a mail went out, so a throttled
+	// request is only logged
+	last, err := userStore.LastTokenCreatedAt(user.ID, tokenPurposePasswordReset)
+	if err != nil {
+		log.Printf("Error checking last password reset: %v", err)
+		return
+	}
+	if time.Since(last) < passwordResetInterval {
+		log.Printf("Password reset for user %s requested again within %s; not sending", user.Username, passwordResetInterval)
+		return
+	}
+
+	err = mailPasswordReset(user)
+	if err != nil {
+		log.Printf("Error sending password reset email: %v", err)
+	}
+}
+
+// mailPasswordReset queues a password reset link to user's email address.
+func mailPasswordReset(user User) error {
+	secret, err := issueAccountToken(user.ID, tokenPurposePasswordReset, user.Email, passwordResetTTL)
+	if err != nil {
+		return fmt.Errorf("error creating password reset token: %v", err)
+	}
+
+	err = sendEmail("password_reset", user.Email, struct {
+		Username     string
+		Link         string
+		ValidMinutes int
+	}{
+		Username:     user.Username,
+		Link:         publicURL("/password/reset?token=" + url.QueryEscape(secret)),
+		ValidMinutes: int(passwordResetTTL.Minutes()),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Password reset link queued for user %s", user.Username)
+	return nil
+}
+
+// resetPasswordHandler shows the new password form for a reset link (GET)
+// and sets the password (POST). A token works once; resetting ends every
+// existing session of the account.
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "templates/reset.html", struct{ Token string }{Token: r.URL.Query().Get("token")})
+	case http.MethodPost:
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Check the new password before using up the link, so a rejected
+		// password can be corrected and tried again
+		token, err := lookupAccountToken(tokenPurposePasswordReset, body.Token)
+		if err == ErrTokenInvalid {
+			http.Error(w, "Invalid or expired reset link", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up password reset token: %v", err)
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+		user, err := userStore.GetUserByID(token.UserID)
+		if err != nil {
+			log.Printf("Error finding user for password reset: %v", err)
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+		fieldErrors := checkPasswordPolicy(body.Password, user.Username, user.Email)
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		token, err = redeemAccountToken(tokenPurposePasswordReset, body.Token)
+		if err == ErrTokenInvalid {
+			http.Error(w, "Invalid or expired reset link", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error redeeming password reset token: %v", err)
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+
+		err = setPassword(token.UserID, body.Password)
+		if err != nil {
+			log.Printf("Error resetting password: %v", err)
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(auditPasswordReset, user.ID, user.Username, r, "password reset by email link; all sessions ended")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset. Please sign in."})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setPassword replaces the password of user userID and signs the account
+// out everywhere.
+func setPassword(userID int, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+
+	user, err := userStore.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	user.Password = hashedPassword
+	err = userStore.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = userStore.InvalidateSessions(userID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Password changed for user %s; existing sessions ended", user.Username)
+	return nil
+}
+
+// accountPasswordHandler shows the password form (GET) and changes the
+// signed-in user's password (POST). Changing takes the current password and
+// ends every other session of the account. An account without a password,
+// such as one created by signing in with a provider, sets one instead, with
+// no current password to give.
+func accountPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "templates/password.html", struct {
+			Username    string
+			HasPassword bool
+		}{
+			Username:    user.Username,
+			HasPassword: user.Password != "",
+		})
+	case http.MethodPost:
+		var body struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hadPassword := user.Password != ""
+		if hadPassword {
+			// The current password is guessable through a stolen session,
+			// so wrong ones count like failed sign-ins
+			if !checkLoginAllowed(w, r, &user) {
+				return
+			}
+			ok, _ := verifyPassword(body.CurrentPassword, user.Password)
+			if !ok {
+				recordLoginFailure(r, &user)
+				writeFieldErrors(w, []FieldError{{Field: "current_password", Code: "incorrect", Message: "Current password is incorrect"}})
+				return
+			}
+			recordLoginSuccess(r, user)
+		}
+
+		fieldErrors := checkPasswordPolicy(body.NewPassword, user.Username, user.Email)
+		if len(fieldErrors) > 0 {
+			for i := range fieldErrors {
+				fieldErrors[i].Field = "new_password"
+			}
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		err = setPassword(user.ID, body.NewPassword)
+		if err != nil {
+			log.Printf("Error changing password: %v", err)
+			http.Error(w, "Error changing password", http.StatusInternalServerError)
+			return
+		}
+
+		// setPassword ended every session; give this browser a new one
+		user, err = userStore.GetUserByID(user.ID)
+		if err == nil {
+			err = startSession(w, r, user)
+		}
+		if err != nil {
+			log.Printf("Error restarting session after password change: %v", err)
+			http.Error(w, "Password changed, but you have been signed out", http.StatusInternalServerError)
+			return
+		}
+
+		message := "Password changed. Other sessions have been signed out."
+		if hadPassword {
+			recordAudit(auditPasswordChanged, user.ID, user.Username, r, "password changed; other sessions ended")
+		} else {
+			recordAudit(auditPasswordSet, user.ID, user.Username, r, "password set on account without one")
+			message = "Password set. You can now sign in with it."
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// generatedPasswordCost is the bcrypt cost earlier versions hashed every
+// password with, including the random six-digit one they gave accounts
+// created by signing in with Google.
+const generatedPasswordCost = 14
+
+// clearGeneratedPassword removes user's password when password, already
+// verified against it, is the six-digit one earlier versions generated for
+// accounts created by signing in with a provider. Nobody was shown that
+// password, so signing in with it means it was guessed. It reports whether
+// it cleared the password; the caller then refuses the sign-in as it would
+// for an account without one.
+//
+// A password the user chose can't be told apart by its hash, so the match
+// is narrow: six digits, a bcrypt hash still at the old cost, and a linked
+// identity whose email is the username, as the old sign-in created them.
+func clearGeneratedPassword(r *http.Request, user User, password string) bool {
+	if len(password) != 6 || strings.Trim(password, "0123456789") != "" {
+		return false
+	}
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err != nil || cost != generatedPasswordCost {
+		return false
+	}
+	identities, err := userStore.ListIdentities(user.ID)
+	if err != nil {
+		log.Printf("Error listing identities of user %s: %v", user.Username, err)
+		return false
+	}
+	created := false
+	for _, identity := range identities {
+		if strings.EqualFold(identity.Email, user.Username) {
+			created = true
+		}
+	}
+	if !created {
+		return false
+	}
+
+	user.Password = ""
+	err = userStore.UpdateUser(user)
+	if err != nil {
+		log.Printf("Error removing generated password of user %s: %v", user.Username, err)
+		return false
+	}
+	recordAudit(auditGeneratedPasswordCleared, user.ID, "system", r, "generated six-digit password used to sign in; password removed")
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createLegacyUser stores an account the way earlier versions created it on
+// a Google sign-in, with the email as the username, as migrated by 0002.
+func createLegacyUser(t *testing.T, email, hash string) User {
+	t.Helper()
+	now := time.Now()
+	user := User{MembershipID: generateMembershipID(), Username: email, Email: strings.ToLower(email), EmailVerifiedAt: &now, Password: hash}
+	if err := userStore.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestGeneratedPasswordCleared(t *testing.T) {
+	setupTestServer(t)
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte("042917"), generatedPasswordCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheapHash, err := bcrypt.GenerateFromPassword([]byte("042917"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		hash     string
+		identity string
+		cleared  bool
+	}{
+		{"created by a provider", string(legacyHash), "alice@example.com", true},
+		{"signed up with an email username", string(legacyHash), "", false},
+		{"linked an identity with another email", string(legacyHash), "alice@example.net", false},
+		{"password set since", string(cheapHash), "alice@example.com", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			userStore = newMemoryStore()
+			user := createLegacyUser(t, "alice@example.com", test.hash)
+			if test.identity != "" {
+				identity := Identity{UserID: user.ID, Provider: "google", Subject: "1234", Email: test.identity, EmailVerified: true}
+				if err := userStore.CreateIdentity(&identity); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice@example.com","password":"042917"}`)
+			stored, _ := userStore.GetUserByID(user.ID)
+			if test.cleared {
+				if w.Code != http.StatusForbidden || stored.Password != "" {
+					t.Fatalf("got %d %s, password %q; want 403 and no password", w.Code, w.Body, stored.Password)
+				}
+				return
+			}
+			if w.Code != http.StatusSeeOther || stored.Password == "" {
+				t.Fatalf("got %d %s, password %q; want a sign-in that keeps it", w.Code, w.Body, stored.Password)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// bcryptMaxBytes is the longest password bcrypt can hash.
+const bcryptMaxBytes = 72
+
+// minContextWordLength is the shortest context word checked for; shorter
+// ones (a username like "jo") would reject too many good passwords.
+const minContextWordLength = 4
+
+// passwordPolicy decides which new passwords are accepted. It is set from
+// the environment by loadPasswordPolicy.
+var passwordPolicy = struct {
+	minLength int // in characters
+	maxBytes  int
+	// bannedWords may not appear in any password, besides the user's own
+	// username and email.
+	bannedWords []string
+	// breachedDir holds the breached-password list as files named by the
+	// first five hex digits of the SHA-1 (ABCDE.txt), each with lines of
+	// "<remaining 35 hex digits>:<count>", as served by the Pwned
+	// Passwords range API. Empty disables the check.
+	breachedDir      string
+	breachedMinCount int
+}{
+	minLength:        8,
+	maxBytes:         bcryptMaxBytes,
+	breachedMinCount: 1,
+}
+
+// loadPasswordPolicy configures the password policy from the environment:
+//
+//	PASSWORD_MIN_LENGTH           minimum characters (default 8)
+//	PASSWORD_MAX_BYTES            maximum bytes (default and, with bcrypt, at most 72)
+//	PASSWORD_BANNED_WORDS         comma-separated words passwords may not contain
+//	PASSWORD_BREACHED_DIR         directory of breached-password prefix files
+//	PASSWORD_BREACHED_MIN_COUNT   breach count from which a password is refused (default 1)
+//
+// It must run after initPasswordHasher.
+func loadPasswordPolicy() error {
+	p := &passwordPolicy
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &p.minLength},
+		{"PASSWORD_MAX_BYTES", &p.maxBytes},
+		{"PASSWORD_BREACHED_MIN_COUNT", &p.breachedMinCount},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid %s: %s", setting.name, value)
+			}
+			*setting.value = n
+		}
+	}
+	if p.maxBytes < p.minLength {
+		return fmt.Errorf("PASSWORD_MAX_BYTES (%d) is less than PASSWORD_MIN_LENGTH (%d)", p.maxBytes, p.minLength)
+	}
+	if _, ok := passwordHasher.(*bcryptHasher); ok && p.maxBytes > bcryptMaxBytes {
+		return fmt.Errorf("PASSWORD_MAX_BYTES can be at most %d with bcrypt", bcryptMaxBytes)
+	}
+
+	p.bannedWords = nil
+	for _, word := range splitList(os.Getenv("PASSWORD_BANNED_WORDS")) {
+		p.bannedWords = append(p.bannedWords, strings.ToLower(word))
+	}
+
+	p.breachedDir = os.Getenv("PASSWORD_BREACHED_DIR")
+	if p.breachedDir != "" {
+		info, err := os.Stat(p.breachedDir)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("PASSWORD_BREACHED_DIR is not a directory: %s", p.breachedDir)
+		}
+	}
+
+	log.Printf("Password policy: at least %d characters, at most %d bytes, %d banned words, breached check %v",
+		p.minLength, p.maxBytes, len(p.bannedWords), p.breachedDir != "")
+	return nil
+}
+
+// checkPasswordPolicy returns the policy's objections to password as a new
+// password for the account with username and email, or nil if it is
+// acceptable.
+func checkPasswordPolicy(password, username, email string) []FieldError {
+	p := passwordPolicy
+	if password == "" {
+		return []FieldError{{Field: "password", Code: "required", Message: "Password is required"}}
+	}
+
+	var errs []FieldError
+	if utf8.RuneCountInString(password) < p.minLength {
+		errs = append(errs, FieldError{Field: "password", Code: "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters", p.minLength)})
+	}
+	if len(password) > p.maxBytes {
+		errs = append(errs, FieldError{Field: "password", Code: "too_long",
+			Message: fmt.Sprintf("Password must be at most %d bytes", p.maxBytes)})
+	}
+
+	lower := strings.ToLower(password)
+	words := append([]string{strings.ToLower(username)}, p.bannedWords...)
+	if email != "" {
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		words = append(words, local)
+	}
+	for _, word := range words {
+		if utf8.RuneCountInString(word) >= minContextWordLength && strings.Contains(lower, word) {
+			errs = append(errs, FieldError{Field: "password", Code: "contains_context",
+				Message: "Password must not contain your username, email address or a banned word"})
+			break
+		}
+	}
+
+	// Only look a password up once it passes the cheap checks
+	if len(errs) == 0 && p.breachedDir != "" {
+		breached, err := isBreachedPassword(password)
+		if err != nil {
+			// Fail open: a missing or unreadable list shouldn't stop
+			// everyone from choosing a password
+			log.Printf("Error checking breached passwords: %v", err)
+		}
+		if breached {
+			errs = append(errs, FieldError{Field: "password", Code: "breached",
+				Message: "This password has appeared in a data breach; please choose another"})
+		}
+	}
+	return errs
+}
+
+// isBreachedPassword reports whether password is in the breached-password
+// list at least breachedMinCount times. Only the prefix file for its hash
+// is read.
+func isBreachedPassword(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(passwordPolicy.breachedDir, prefix+".txt"))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !found || !strings.EqualFold(entry, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return false, fmt.Errorf("malformed entry in %s.txt: %q", prefix, scanner.Text())
+		}
+		return n >= passwordPolicy.breachedMinCount, nil
+	}
+	return false, scanner.Err()
+}
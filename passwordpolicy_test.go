@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// usePasswordPolicy loads the password policy with env set, and puts the
+// previous policy back when the test ends.
+func usePasswordPolicy(t *testing.T, env map[string]string) {
+	t.Helper()
+	previous := passwordPolicy
+	t.Cleanup(func() { passwordPolicy = previous })
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	if err := loadPasswordPolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fieldErrorCodes(errs []FieldError) string {
+	var codes []string
+	for _, err := range errs {
+		codes = append(codes, err.Field+":"+err.Code)
+	}
+	return strings.Join(codes, ",")
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	usePasswordPolicy(t, map[string]string{"PASSWORD_MIN_LENGTH": "10", "PASSWORD_BANNED_WORDS": "Acme, widget"})
+
+	for _, test := range []struct {
+		name     string
+		password string
+		username string
+		want     string
+	}{
+		{"acceptable", "Correct-Horse-77", "alice", ""},
+		{"empty", "", "alice", "password:required"},
+		{"too short", "Short-77", "alice", "password:too_short"},
+		{"length in characters", "ĉĝĥĵŝŭĉĝĥĵ", "alice", ""},
+		{"too long", strings.Repeat("x", 73), "alice", "password:too_long"},
+		{"contains username", "xxAlice-Horse-77", "alice", "password:contains_context"},
+		{"contains email local part", "Horse-77-alice.w", "bob", "password:contains_context"},
+		{"contains banned word", "my-ACME-password-7", "alice", "password:contains_context"},
+		{"short username is ignored", "Correct-Horse-jo-77", "jo", ""},
+		{"short and has the username", "alice-77", "alice", "password:too_short,password:contains_context"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := fieldErrorCodes(checkPasswordPolicy(test.password, test.username, "alice.w@example.com"))
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadPasswordPolicyRejectsBadSettings(t *testing.T) {
+	previous := passwordPolicy
+	t.Cleanup(func() { passwordPolicy = previous })
+	useTestHasher(t, "bcrypt")
+
+	for _, env := range []map[string]string{
+		{"PASSWORD_MIN_LENGTH": "0"},
+		{"PASSWORD_MIN_LENGTH": "ten"},
+		{"PASSWORD_MIN_LENGTH": "20", "PASSWORD_MAX_BYTES": "16"},
+		{"PASSWORD_MAX_BYTES": "100"}, // more than bcrypt can hash
+		{"PASSWORD_BREACHED_DIR": filepath.Join(t.TempDir(), "missing")},
+	} {
+		t.Run(strings.Join(mapKeys(env), ","), func(t *testing.T) {
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			if err := loadPasswordPolicy(); err == nil {
+				t.Fatalf("accepted %v", env)
+			}
+		})
+	}
+}
+
+func mapKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestBreachedPasswordCheck(t *testing.T) {
+	dir := t.TempDir()
+	writeBreached := func(password, count string) {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		file, err := os.OpenFile(filepath.Join(dir, hash[:5]+".txt"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.WriteString("0000000000000000000000000000000000A:9\r\n" + hash[5:] + ":" + count + "\r\n")
+	}
+	writeBreached("Correct-Horse-77", "3")
+	writeBreached("Rarely-Leaked-77", "1")
+	writeBreached("Garbled-Entry-77", "many")
+	usePasswordPolicy(t, map[string]string{"PASSWORD_BREACHED_DIR": dir, "PASSWORD_BREACHED_MIN_COUNT": "2"})
+
+	for _, test := range []struct {
+		password string
+		want     string
+	}{
+		{"Correct-Horse-77", "password:breached"},
+		{"Rarely-Leaked-77", ""},        // below PASSWORD_BREACHED_MIN_COUNT
+		{"Never-Leaked-77", ""},         // no prefix file: fail open
+		{"Garbled-Entry-77", ""},        // unreadable entry: fail open
+		{"short", "password:too_short"}, // cheap checks come first
+	} {
+		if got := fieldErrorCodes(checkPasswordPolicy(test.password, "alice", "")); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.password, got, test.want)
+		}
+	}
+}
+
+func TestSignupFieldErrors(t *testing.T) {
+	setupTestServer(t)
+	usePasswordPolicy(t, nil)
+
+	for _, test := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"missing everything", `{}`, "username:required,email:required,password:required"},
+		{"invalid email", `{"username":"alice","email":"alice at example.com","password":"Correct-Horse-77"}`, "email:invalid"},
+		{"weak password", `{"username":"alice","email":"alice@example.com","password":"alice123"}`, "password:contains_context"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(signupHandler, http.MethodPost, "/signup", test.body)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got %d %s", w.Code, w.Body)
+			}
+			var body struct {
+				Errors []FieldError `json:"errors"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if got := fieldErrorCodes(body.Errors); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if users, _ := userStore.ListUsers(); len(users) != 0 {
+		t.Fatalf("rejected signups created %d users", len(users))
+	}
+}
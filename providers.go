@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const googleIssuer = "https://accounts.google.com"
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// providerConfig describes one OpenID Connect provider. It is the shape of
+// an entry in OIDC_PROVIDERS_FILE and of the OIDC_<NAME>_* variables.
+type providerConfig struct {
+	// Name is the provider's URL segment: /auth/{name}/login.
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Issuer      string `json:"issuer"`
+
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	// AuthURL and TokenURL skip endpoint discovery when set.
+	AuthURL  string `json:"auth_url"`
+	TokenURL string `json:"token_url"`
+
+	Claims claimMapping `json:"claims"`
+}
+
+// claimMapping names the ID token claims a provider uses for the fields we
+// need. Empty names fall back to the standard OIDC claims.
+type claimMapping struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	// TrustEmail treats every email the provider returns as verified, for
+	// providers that don't issue email_verified and only hand out addresses
+	// they have verified themselves. Don't use it with Microsoft Entra: a
+	// user can set any email on an account in a tenant they control, and a
+	// multi-tenant app would then link it to the victim's account ("nOAuth").
+	TrustEmail bool `json:"trust_email"`
+}
+
+// idTokenClaims are the ID token claims the login flow relies on.
+type idTokenClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// oauthProvider is a configured, ready to use entry of the registry.
+type oauthProvider struct {
+	Name        string
+	DisplayName string
+
+	config oauth2.Config
+	oidc   *oidcProvider
+	claims claimMapping
+}
+
+var (
+	oauthProviders     = map[string]*oauthProvider{}
+	oauthProviderOrder []string
+)
+
+// enabledProviders returns the registered providers in configuration order.
+func enabledProviders() []*oauthProvider {
+	providers := make([]*oauthProvider, 0, len(oauthProviderOrder))
+	for _, name := range oauthProviderOrder {
+		providers = append(providers, oauthProviders[name])
+	}
+	return providers
+}
+
+// initProviders builds the provider registry. Google is configured from the
+// GOOGLE_OAUTH_* variables, then come the entries of OIDC_PROVIDERS_FILE
+// (a JSON array of providerConfig), then each name listed in OIDC_PROVIDERS
+// from its OIDC_<NAME>_* variables.
+func initProviders() error {
+	var configs []providerConfig
+
+	if os.Getenv("GOOGLE_OAUTH_CLIENT_ID") != "" {
+		configs = append(configs, providerConfig{
+			Name:         "google",
+			DisplayName:  "Google",
+			Issuer:       googleIssuer,
+			ClientID:     os.Getenv("GOOGLE_OAUTH_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("GOOGLE_OAUTH_REDIRECT_URL"),
+			AuthURL:      google.Endpoint.AuthURL,
+			TokenURL:     google.Endpoint.TokenURL,
+		})
+	}
+
+	if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+		fileConfigs, err := loadProviderFile(path)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, fileConfigs...)
+	}
+
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		configs = append(configs, providerConfigFromEnv(name))
+	}
+
+	for _, config := range configs {
+		err := registerProvider(config)
+		if err != nil {
+			return err
+		}
+		log.Printf("OAuth provider enabled: %s (%s)", config.Name, config.Issuer)
+	}
+
+	return nil
+}
+
+func loadProviderFile(path string) ([]providerConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	var configs []providerConfig
+	err = json.Unmarshal(content, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return configs, nil
+}
+
+func providerConfigFromEnv(name string) providerConfig {
+	prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	env := func(key string) string { return os.Getenv(prefix + key) }
+
+	trustEmail, _ := strconv.ParseBool(env("TRUST_EMAIL"))
+	return providerConfig{
+		Name:         name,
+		DisplayName:  env("DISPLAY_NAME"),
+		Issuer:       env("ISSUER"),
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		RedirectURL:  env("REDIRECT_URL"),
+		Scopes:       splitList(env("SCOPES")),
+		AuthURL:      env("AUTH_URL"),
+		TokenURL:     env("TOKEN_URL"),
+		Claims: claimMapping{
+			Subject:       env("SUBJECT_CLAIM"),
+			Email:         env("EMAIL_CLAIM"),
+			EmailVerified: env("EMAIL_VERIFIED_CLAIM"),
+			TrustEmail:    trustEmail,
+		},
+	}
+}
+
+// registerProvider validates config, fills in defaults and adds it to the
+// registry.
+func registerProvider(config providerConfig) error {
+	if !providerNamePattern.MatchString(config.Name) {
+		return fmt.Errorf("invalid OAuth provider name %q", config.Name)
+	}
+	if _, exists := oauthProviders[config.Name]; exists {
+		return fmt.Errorf("OAuth provider %s is configured twice", config.Name)
+	}
+	if config.Issuer == "" || config.ClientID == "" {
+		return fmt.Errorf("OAuth provider %s needs an issuer and a client ID", config.Name)
+	}
+	if (config.AuthURL == "") != (config.TokenURL == "") {
+		return fmt.Errorf("OAuth provider %s needs both auth_url and token_url, or neither", config.Name)
+	}
+
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	if config.RedirectURL == "" {
+		baseURL := os.Getenv("PUBLIC_BASE_URL")
+		if baseURL == "" {
+			return fmt.Errorf("OAuth provider %s needs a redirect URL or PUBLIC_BASE_URL", config.Name)
+		}
+		config.RedirectURL = strings.TrimSuffix(baseURL, "/") + "/auth/" + config.Name + "/callback"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email"}
+	}
+	if !containsString(config.Scopes, oidc.ScopeOpenID) {
+		config.Scopes = append([]string{oidc.ScopeOpenID}, config.Scopes...)
+	}
+
+	oauthProviders[config.Name] = &oauthProvider{
+		Name:        config.Name,
+		DisplayName: config.DisplayName,
+		config: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       config.Scopes,
+			Endpoint:     oauth2.Endpoint{AuthURL: config.AuthURL, TokenURL: config.TokenURL},
+		},
+		oidc:   newOIDCProvider(config.Issuer, config.ClientID, nil),
+		claims: config.Claims,
+	}
+	oauthProviderOrder = append(oauthProviderOrder, config.Name)
+	return nil
+}
+
+// oauth2Config returns the provider's OAuth configuration, with endpoints
+// from discovery unless they were configured explicitly.
+func (p *oauthProvider) oauth2Config() (*oauth2.Config, error) {
+	config := p.config
+	if config.Endpoint.AuthURL == "" {
+		endpoint, err := p.oidc.endpoint()
+		if err != nil {
+			return nil, err
+		}
+		config.Endpoint = endpoint
+	}
+	return &config, nil
+}
+
+// mapClaims extracts the login fields from a verified ID token according to
+// the provider's claim mapping.
+func (p *oauthProvider) mapClaims(idToken *oidc.IDToken) (idTokenClaims, error) {
+	var raw map[string]interface{}
+	err := idToken.Claims(&raw)
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("error parsing id token claims: %v", err)
+	}
+
+	claims := idTokenClaims{Subject: idToken.Subject}
+	if p.claims.Subject != "" {
+		claims.Subject = claimString(raw, p.claims.Subject)
+	}
+	claims.Email = claimString(raw, firstNonEmpty(p.claims.Email, "email"))
+
+	if p.claims.TrustEmail {
+		claims.EmailVerified = claims.Email != ""
+	} else {
+		// Some providers send the flag as the string "true".
+		switch verified := raw[firstNonEmpty(p.claims.EmailVerified, "email_verified")].(type) {
+		case bool:
+			claims.EmailVerified = verified
+		case string:
+			claims.EmailVerified, _ = strconv.ParseBool(verified)
+		}
+	}
+
+	return claims, nil
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
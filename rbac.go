@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Permissions, granted to users through their roles (see migration 0011).
+// A new protected endpoint gets a new permission, and a migration granting
+// it to the roles that should have it.
+const (
+	permUsersList      = "users.list"
+	permUsersUnlock    = "users.unlock"
+	permSessionsRevoke = "sessions.revoke"
+	permPasswordReport = "passwords.report"
+	permRolesManage    = "roles.manage"
+	permUsersView      = "users.view"
+	permUsersSuspend   = "users.suspend"
+	permUsersReset     = "users.reset"
+	permUsersDelete    = "users.delete"
+)
+
+// roleAdmin is the role created by migration 0011 with every permission
+// (later migrations grant it new ones).
+const roleAdmin = "admin"
+
+// adminPermissions are the permissions of roleAdmin, for the memory store,
+// which has no migrations.
+var adminPermissions = []string{
+	permUsersList, permUsersUnlock, permSessionsRevoke, permPasswordReport, permRolesManage,
+	permUsersView, permUsersSuspend, permUsersReset, permUsersDelete,
+}
+
+type requestUserKey struct{}
+
+// requirePermission wraps a route's handler so that it only runs for a
+// signed-in user with permission. The user is available to it through
+// requestUser.
+func requirePermission(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := currentUser(r)
+		if err != nil {
+			writeUnauthorized(w, r)
+			return
+		}
+		if !hasPermission(user, permission) {
+			log.Printf("User %s lacks permission %s for %s", user.Username, permission, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestUserKey{}, user)))
+	}
+}
+
+// requestUser returns the user requirePermission let through.
+func requestUser(r *http.Request) User {
+	user, _ := r.Context().Value(requestUserKey{}).(User)
+	return user
+}
+
+// hasPermission reports whether any of user's roles grants permission. An
+// error looking it up counts as no.
+func hasPermission(user User, permission string) bool {
+	permissions, err := userStore.ListUserPermissions(user.ID)
+	if err != nil {
+		log.Printf("Error getting permissions of user %s: %v", user.Username, err)
+		return false
+	}
+	return containsString(permissions, permission)
+}
+
+// bootstrapAdmin gives the admin role to the user named by INITIAL_ADMIN,
+// but only while nobody has it, so that a new installation can get its
+// first admin without database access. The account must already exist:
+// granting it at sign-up would give the role to whoever registered the
+// name first.
+func bootstrapAdmin() error {
+	if os.Getenv("ADMIN_USERNAMES") != "" {
+		log.Println("WARNING: ADMIN_USERNAMES is no longer used; grant the admin role with INITIAL_ADMIN or the grant-role command")
+	}
+
+	username := os.Getenv("INITIAL_ADMIN")
+	if username == "" {
+		return nil
+	}
+	// GetUser also matches emails; only the username counts here
+	user, err := userStore.GetUser(username)
+	if err == nil && user.Username != username {
+		err = ErrUserNotFound
+	}
+	if err == ErrUserNotFound {
+		log.Printf("INITIAL_ADMIN %s has no account yet; sign up and restart to make it an admin", username)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	admins, err := userStore.CountUsersWithRole(roleAdmin)
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+
+	err = userStore.AssignRole(user.ID, roleAdmin)
+	if err != nil {
+		return err
+	}
+	log.Printf("Granted the admin role to INITIAL_ADMIN %s", user.Username)
+	recordAudit(auditRoleGranted, user.ID, "INITIAL_ADMIN", nil, "role admin granted to first admin "+user.Username)
+	return nil
+}
+
+// changeRole grants or revokes role for user on behalf of actor. The last
+// admin can't lose the admin role, so there is always someone to grant it.
+func changeRole(user User, role string, grant bool, actor string, r *http.Request) error {
+	if grant {
+		err := userStore.AssignRole(user.ID, role)
+		if err != nil {
+			return err
+		}
+		recordAudit(auditRoleGranted, user.ID, actor, r, fmt.Sprintf("role %s granted to %s", role, user.Username))
+		return nil
+	}
+
+	if role == roleAdmin {
+		last, err := isLastAdmin(user)
+		if err != nil {
+			return err
+		}
+		if last {
+			return errLastAdmin
+		}
+	}
+	err := userStore.RemoveRole(user.ID, role)
+	if err != nil {
+		return err
+	}
+	recordAudit(auditRoleRevoked, user.ID, actor, r, fmt.Sprintf("role %s revoked from %s", role, user.Username))
+	return nil
+}
+
+var errLastAdmin = fmt.Errorf("the last admin can't lose the admin role")
+
+// isLastAdmin reports whether user is the only one with the admin role.
+func isLastAdmin(user User) (bool, error) {
+	roles, err := userStore.ListUserRoles(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if !containsString(roles, roleAdmin) {
+		return false, nil
+	}
+	admins, err := userStore.CountUsersWithRole(roleAdmin)
+	if err != nil {
+		return false, err
+	}
+	return admins <= 1, nil
+}
+
+// roleHandler grants (/admin/roles/grant) or revokes (/admin/roles/revoke)
+// a role ({"username": "...", "role": "..."}).
+func roleHandler(grant bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			Username string `json:"username"`
+			Role     string `json:"role"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := userStore.GetUser(body.Username)
+		if err == ErrUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = changeRole(user, body.Role, grant, requestUser(r).Username, r)
+		}
+		switch err {
+		case nil:
+		case ErrRoleNotFound:
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		case errLastAdmin:
+			http.Error(w, "The last admin can't lose the admin role", http.StatusConflict)
+			return
+		default:
+			log.Printf("Error changing roles: %v", err)
+			http.Error(w, "Error changing roles", http.StatusInternalServerError)
+			return
+		}
+
+		roles, err := userStore.ListUserRoles(user.ID)
+		if err != nil {
+			log.Printf("Error listing roles: %v", err)
+			http.Error(w, "Error changing roles", http.StatusInternalServerError)
+			return
+		}
+		if roles == nil {
+			roles = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"username": user.Username,
+			"roles":    roles,
+		})
+	}
+}
+
+// runRoleCommand implements "grant-role <username> <role>" and
+// "revoke-role <username> <role>".
+func runRoleCommand(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: %s <username> <role>", name)
+	}
+
+	err = initStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	user, err := userStore.GetUser(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error finding user %s: %v", flags.Arg(0), err)
+	}
+	err = changeRole(user, flags.Arg(1), name == "grant-role", "cli", nil)
+	if err != nil {
+		return err
+	}
+
+	roles, err := userStore.ListUserRoles(user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Roles of %s: %v\n", user.Username, roles)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// signIn signs username in with password and returns the session cookie.
+func signIn(t *testing.T, username, password string) *http.Cookie {
+	t.Helper()
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"`+username+`","password":"`+password+`"}`)
+	cookie := responseCookie(w, sessionCookieName)
+	if w.Code != http.StatusSeeOther || cookie == nil {
+		t.Fatalf("sign-in of %s: got %d %s", username, w.Code, w.Body)
+	}
+	return cookie
+}
+
+func TestRequirePermission(t *testing.T) {
+	setupTestServer(t)
+	admin := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	createTestUser(t, "bob", "Correct-Horse-77-battery")
+	if err := userStore.AssignRole(admin.ID, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	adminCookie := signIn(t, "alice", "Correct-Horse-77-battery")
+	userCookie := signIn(t, "bob", "Correct-Horse-77-battery")
+
+	var seen User
+	protected := requirePermission(permUsersList, func(w http.ResponseWriter, r *http.Request) {
+		seen = requestUser(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, test := range []struct {
+		name   string
+		cookie *http.Cookie
+		want   int
+	}{
+		{"signed out", nil, http.StatusUnauthorized},
+		{"without the permission", userCookie, http.StatusForbidden},
+		{"admin", adminCookie, http.StatusNoContent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			seen = User{}
+			var cookies []*http.Cookie
+			if test.cookie != nil {
+				cookies = append(cookies, test.cookie)
+			}
+			w := serve(protected, http.MethodGet, "/users", "", cookies...)
+			if w.Code != test.want {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, test.want)
+			}
+			if test.want == http.StatusNoContent && seen.ID != admin.ID {
+				t.Fatalf("handler saw user %q, want alice", seen.Username)
+			}
+			if test.want != http.StatusNoContent && seen.ID != 0 {
+				t.Fatal("handler ran")
+			}
+		})
+	}
+
+	// Losing the role takes effect on the next request
+	if err := userStore.RemoveRole(admin.ID, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(protected, http.MethodGet, "/users", "", adminCookie); w.Code != http.StatusForbidden {
+		t.Fatalf("after revoking the role: got %d, want 403", w.Code)
+	}
+}
+
+func TestUsersRouteNeedsAdmin(t *testing.T) {
+	setupTestServer(t)
+	admin := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	createTestUser(t, "bob", "Correct-Horse-77-battery")
+	userStore.AssignRole(admin.ID, roleAdmin)
+	users := requirePermission(permUsersList, getUsersHandler)
+
+	if w := serve(users, http.MethodGet, "/users", "", signIn(t, "bob", "Correct-Horse-77-battery")); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d, want 403", w.Code)
+	}
+	if w := serve(users, http.MethodGet, "/users", "", signIn(t, "alice", "Correct-Horse-77-battery")); w.Code != http.StatusOK {
+		t.Fatalf("admin: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLastAdminKeepsRole(t *testing.T) {
+	setupTestServer(t)
+	alice := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	bob := createTestUser(t, "bob", "Correct-Horse-77-battery")
+	if err := changeRole(alice, roleAdmin, true, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := changeRole(alice, roleAdmin, false, "test", nil); err != errLastAdmin {
+		t.Fatalf("revoking the last admin: got %v, want errLastAdmin", err)
+	}
+
+	if err := changeRole(bob, roleAdmin, true, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := changeRole(alice, roleAdmin, false, "test", nil); err != nil {
+		t.Fatalf("revoking one of two admins: %v", err)
+	}
+	if hasPermission(alice, permRolesManage) || !hasPermission(bob, permRolesManage) {
+		t.Fatal("wrong permissions after the change")
+	}
+}
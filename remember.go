@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// rememberCookieName holds the token of a "remember me" login. The token is
+// random and looked up by its hash, so unlike the session cookie it isn't
+// signed.
+const rememberCookieName = "remember-me"
+
+// rememberSignIn gives r's browser a persistent login for user, which signs
+// it back in after its session has ended.
+func rememberSignIn(w http.ResponseWriter, r *http.Request, user User) error {
+	token := generateRandomToken(32)
+	login := PersistentLogin{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+		ExpiresAt: time.Now().Add(sessionTimeouts.rememberMe),
+	}
+	err := userStore.CreatePersistentLogin(&login)
+	if err != nil {
+		return err
+	}
+
+	setRememberCookie(w, token, int(sessionTimeouts.rememberMe/time.Second))
+	log.Printf("Remembering sign-in of user %s for %s", user.Username, sessionTimeouts.rememberMe)
+	return nil
+}
+
+// setRememberCookie sets the remember-me cookie, or deletes it if maxAge is
+// negative.
+func setRememberCookie(w http.ResponseWriter, token string, maxAge int) {
+	options := *store.Options
+	options.MaxAge = maxAge
+	http.SetCookie(w, sessions.NewCookie(rememberCookieName, token, &options))
+}
+
+// forgetSignIn revokes the persistent login of r's browser, if it has one.
+func forgetSignIn(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(rememberCookieName)
+	if err != nil {
+		return
+	}
+	err = userStore.DeletePersistentLoginByToken(hashToken(cookie.Value))
+	if err != nil {
+		log.Printf("Error deleting persistent login: %v", err)
+	}
+	setRememberCookie(w, "", -1)
+}
+
+// withRememberedSignIn signs a browser back in with its persistent login
+// when its session has ended, before next handles the request.
+func withRememberedSignIn(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(rememberCookieName); err == nil {
+			if _, err := currentUser(r); err != nil {
+				resumePersistentLogin(w, r, cookie.Value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func resumePersistentLogin(w http.ResponseWriter, r *http.Request, token string) {
+	login, err := userStore.GetPersistentLogin(hashToken(token))
+	if err == ErrLoginNotFound {
+		setRememberCookie(w, "", -1)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting persistent login: %v", err)
+		return
+	}
+
+	user, err := userStore.GetUserByID(login.UserID)
+	if err != nil {
+		log.Printf("Error getting user of persistent login %d: %v", login.ID, err)
+		return
+	}
+	if accountSuspended(user) || !canSignIn(user) {
+		return
+	}
+
+	err = startSession(w, r, user)
+	if err != nil {
+		log.Printf("Error resuming persistent login: %v", err)
+		return
+	}
+	err = userStore.TouchPersistentLogin(login.ID, clientIP(r), r.UserAgent())
+	if err != nil {
+		log.Printf("Error updating persistent login last used time: %v", err)
+	}
+	log.Printf("Signed user %s back in with persistent login %d", user.Username, login.ID)
+}
+
+// persistentLoginsHandler lists the signed-in user's persistent logins. The
+// one of the browser making the request is marked current.
+func persistentLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	views, err := userPersistentLoginViews(r, user.ID)
+	if err != nil {
+		log.Printf("Error listing persistent logins: %v", err)
+		http.Error(w, "Error retrieving remembered devices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// revokePersistentLoginHandler revokes one of the signed-in user's
+// persistent logins ({"id": 3}). Sessions it has already signed back in
+// stay until they end.
+func revokePersistentLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = userStore.DeletePersistentLogin(user.ID, body.ID)
+	if err == ErrLoginNotFound {
+		http.Error(w, "Remembered device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking persistent login: %v", err)
+		http.Error(w, "Error revoking remembered device", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditPersistentLoginRevoked, user.ID, user.Username, r, fmt.Sprintf("persistent login %d revoked", body.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Remembered device revoked"})
+}
+
+// persistentLoginView is a PersistentLogin as shown to its user.
+type persistentLoginView struct {
+	PersistentLogin
+	Current bool `json:"current"`
+}
+
+// userPersistentLoginViews returns the persistent logins of the user with
+// userID, marking the one of r's browser.
+func userPersistentLoginViews(r *http.Request, userID int) ([]persistentLoginView, error) {
+	logins, err := userStore.ListPersistentLogins(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var current string
+	if cookie, err := r.Cookie(rememberCookieName); err == nil {
+		current = hashToken(cookie.Value)
+	}
+	views := make([]persistentLoginView, 0, len(logins))
+	for _, login := range logins {
+		views = append(views, persistentLoginView{PersistentLogin: login, Current: login.TokenHash == current})
+	}
+	return views, nil
+}
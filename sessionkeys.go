@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// minSigningKeyBytes is the shortest signing key accepted; securecookie
+	// recommends 32 or 64 bytes for HMAC-SHA256.
+	minSigningKeyBytes = 32
+	// encryptionKeyBytes is the size of the keys keygen makes (AES-256).
+	encryptionKeyBytes = 32
+)
+
+// sessionKeyPair signs, and optionally encrypts, session cookies.
+type sessionKeyPair struct {
+	signing    []byte
+	encryption []byte // nil if cookies are only signed
+}
+
+// initSessionStores creates store and cookieStore with the timeouts (see
+// loadSessionTimeouts), keys and cookie settings from the environment:
+//
+//	SESSION_KEYS              comma-separated key pairs, newest first
+//	SESSION_KEYS_FILE         file with one key pair per line, newest first
+//	SESSION_COOKIE_SECURE     send cookies over HTTPS only (default: true if PUBLIC_BASE_URL is https)
+//	SESSION_COOKIE_HTTPONLY   hide cookies from scripts (default true)
+//	SESSION_COOKIE_SAMESITE   lax (default), strict or none
+//	SESSION_COOKIE_DOMAIN     domain to send cookies to (default: the host only)
+//
+// A key pair is "<signing key>:<encryption key>" in base64, as printed by
+// the keygen command; the encryption key may be left out. Cookies are made
+// with the first pair and accepted with any of them, so a new pair can be
+// put in front and the old ones dropped once their cookies have expired.
+//
+// Without keys, random ones are made: sessions then end when the process
+// restarts and don't work across several instances.
+func initSessionStores() error {
+	err := loadSessionTimeouts()
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadSessionKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		log.Println("WARNING: no SESSION_KEYS or SESSION_KEYS_FILE set; using random session keys, so sessions end on restart")
+		key, err := generateSessionKeyPair()
+		if err != nil {
+			return err
+		}
+		keys = []sessionKeyPair{key}
+	}
+
+	options, err := loadSessionCookieOptions()
+	if err != nil {
+		return err
+	}
+
+	var keyPairs [][]byte
+	for _, key := range keys {
+		keyPairs = append(keyPairs, key.signing, key.encryption)
+	}
+
+	store = newServerSessionStore(keyPairs...)
+	options.MaxAge = store.Options.MaxAge
+	store.Options = options
+
+	// The OAuth flow cookie has to come back with the provider's redirect,
+	// which a strict cookie wouldn't
+	cookieStore = sessions.NewCookieStore(keyPairs...)
+	flowOptions := *options
+	if flowOptions.SameSite == http.SameSiteStrictMode {
+		flowOptions.SameSite = http.SameSiteLaxMode
+	}
+	flowOptions.MaxAge = cookieStore.Options.MaxAge
+	cookieStore.Options = &flowOptions
+
+	log.Printf("Sessions: %d signing keys, cookie secure %v, SameSite %s, domain %q",
+		len(keys), options.Secure, sameSiteName(options.SameSite), options.Domain)
+	return nil
+}
+
+// loadSessionKeys reads the key pairs from SESSION_KEYS or
+// SESSION_KEYS_FILE.
+func loadSessionKeys() ([]sessionKeyPair, error) {
+	inline, path := os.Getenv("SESSION_KEYS"), os.Getenv("SESSION_KEYS_FILE")
+	if inline != "" && path != "" {
+		return nil, fmt.Errorf("set only one of SESSION_KEYS and SESSION_KEYS_FILE")
+	}
+
+	var entries []string
+	source := "SESSION_KEYS"
+	if path != "" {
+		source = path
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening session key file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading session key file: %v", err)
+		}
+	} else {
+		entries = splitList(inline)
+	}
+
+	var keys []sessionKeyPair
+	for i, entry := range entries {
+		key, err := parseSessionKeyPair(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session key %d in %s: %v", i+1, source, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseSessionKeyPair(entry string) (sessionKeyPair, error) {
+	signing, encryption, hasEncryption := strings.Cut(entry, ":")
+
+	var key sessionKeyPair
+	var err error
+	key.signing, err = base64.StdEncoding.DecodeString(signing)
+	if err != nil {
+		return sessionKeyPair{}, fmt.Errorf("signing key is not base64")
+	}
+	if len(key.signing) < minSigningKeyBytes {
+		return sessionKeyPair{}, fmt.Errorf("signing key must be at least %d bytes", minSigningKeyBytes)
+	}
+
+	if hasEncryption {
+		key.encryption, err = base64.StdEncoding.DecodeString(encryption)
+		if err != nil {
+			return sessionKeyPair{}, fmt.Errorf("encryption key is not base64")
+		}
+		switch len(key.encryption) {
+		case 16, 24, 32:
+		default:
+			return sessionKeyPair{}, fmt.Errorf("encryption key must be 16, 24 or 32 bytes")
+		}
+	}
+	return key, nil
+}
+
+// loadSessionCookieOptions returns the cookie settings from the
+// environment.
+func loadSessionCookieOptions() (*sessions.Options, error) {
+	options := &sessions.Options{
+		Path:     "/",
+		Domain:   os.Getenv("SESSION_COOKIE_DOMAIN"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if base, err := url.Parse(publicURL("/")); err == nil {
+		options.Secure = base.Scheme == "https"
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value *bool
+	}{
+		{"SESSION_COOKIE_SECURE", &options.Secure},
+		{"SESSION_COOKIE_HTTPONLY", &options.HttpOnly},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", setting.name, value)
+			}
+			*setting.value = b
+		}
+	}
+
+	switch value := strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")); value {
+	case "", "lax":
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		options.SameSite = http.SameSiteNoneMode
+		if !options.Secure {
+			return nil, fmt.Errorf("SESSION_COOKIE_SAMESITE=none needs secure cookies")
+		}
+	default:
+		return nil, fmt.Errorf("invalid SESSION_COOKIE_SAMESITE: %s", value)
+	}
+	return options, nil
+}
+
+func sameSiteName(mode http.SameSite) string {
+	switch mode {
+	case http.SameSiteStrictMode:
+		return "strict"
+	case http.SameSiteNoneMode:
+		return "none"
+	default:
+		return "lax"
+	}
+}
+
+func generateSessionKeyPair() (sessionKeyPair, error) {
+	key := sessionKeyPair{
+		signing:    make([]byte, 64),
+		encryption: make([]byte, encryptionKeyBytes),
+	}
+	_, err := rand.Read(key.signing)
+	if err == nil {
+		_, err = rand.Read(key.encryption)
+	}
+	if err != nil {
+		return sessionKeyPair{}, fmt.Errorf("error generating session key: %v", err)
+	}
+	return key, nil
+}
+
+// runKeygenCommand implements "keygen", which prints a new session key pair
+// to put in front of SESSION_KEYS or at the top of SESSION_KEYS_FILE.
+func runKeygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: keygen")
+	}
+
+	key, err := generateSessionKeyPair()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s:%s\n", base64.StdEncoding.EncodeToString(key.signing), base64.StdEncoding.EncodeToString(key.encryption))
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionCookieName = "session-name"
+	// sessionUserIDKey holds the signed-in user's ID in the session values,
+	// so the store knows whose session it is.
+	sessionUserIDKey = "uid"
+	// anonymousSessionTTL is how long a session that never signs in is
+	// kept, e.g. one that only started a passkey ceremony.
+	anonymousSessionTTL = time.Hour
+	// sessionTouchInterval limits how often a session's last-seen time is
+	// written.
+	sessionTouchInterval = time.Minute
+	sessionSweepInterval = time.Hour
+	// minSessionIdleTimeout keeps the idle timeout well above
+	// sessionTouchInterval, which is how late activity may be noticed.
+	minSessionIdleTimeout = 5 * time.Minute
+)
+
+// sessionTimeouts bound how long sessions last. It is set from the
+// environment by loadSessionTimeouts.
+var sessionTimeouts = struct {
+	// idle ends a session that hasn't been used for this long. Each use
+	// moves its expiry forward again.
+	idle time.Duration
+	// absolute ends a session this long after it started, however active.
+	absolute time.Duration
+	// rememberMe is how long a "remember me" login keeps signing its
+	// browser back in.
+	rememberMe time.Duration
+}{
+	idle:       2 * time.Hour,
+	absolute:   24 * time.Hour,
+	rememberMe: 30 * 24 * time.Hour,
+}
+
+// loadSessionTimeouts configures session lifetimes from the environment:
+//
+//	SESSION_IDLE_TIMEOUT       end sessions unused for this long (default 2h)
+//	SESSION_ABSOLUTE_TIMEOUT   end sessions this long after sign-in (default 24h)
+//	REMEMBER_ME_DURATION       lifetime of "remember me" logins (default 720h)
+func loadSessionTimeouts() error {
+	t := &sessionTimeouts
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"SESSION_IDLE_TIMEOUT", &t.idle},
+		{"SESSION_ABSOLUTE_TIMEOUT", &t.absolute},
+		{"REMEMBER_ME_DURATION", &t.rememberMe},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", setting.name, value)
+			}
+			*setting.value = d
+		}
+	}
+	if t.idle < minSessionIdleTimeout {
+		return fmt.Errorf("SESSION_IDLE_TIMEOUT must be at least %s", minSessionIdleTimeout)
+	}
+	if t.absolute < t.idle {
+		return fmt.Errorf("SESSION_ABSOLUTE_TIMEOUT (%s) is less than SESSION_IDLE_TIMEOUT (%s)", t.absolute, t.idle)
+	}
+
+	log.Printf("Session timeouts: idle %s, absolute %s, remember me %s", t.idle, t.absolute, t.rememberMe)
+	return nil
+}
+
+// sessionExpiry returns when a session used now expires: after the idle
+// timeout, but no later than limit, the end of its absolute lifetime.
+func sessionExpiry(signedIn bool, limit time.Time) time.Time {
+	idle := sessionTimeouts.idle
+	if !signedIn && idle > anonymousSessionTTL {
+		idle = anonymousSessionTTL
+	}
+	expires := time.Now().Add(idle)
+	if expires.After(limit) {
+		return limit
+	}
+	return expires
+}
+
+// serverSessionStore is a gorilla sessions.Store that keeps the session
+// values in userStore. The cookie only carries a random token, signed by
+// Codecs; the store keeps its SHA-256 like account tokens, so sessions can
+// be listed and revoked and a database leak doesn't hand out live ones.
+type serverSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newServerSessionStore(keyPairs ...[]byte) *serverSessionStore {
+	s := &serverSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(sessionTimeouts.absolute / time.Second),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge sets the absolute lifetime of new sessions and their cookies, in
+// seconds.
+func (s *serverSessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// Get returns the session called name for r, loading it at most once per
+// request.
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session whose token is in r's cookie. A missing, revoked
+// or expired session gives a new, empty one, which gets a fresh token when
+// saved; a revoked token is never brought back. A loaded session's MaxAge
+// is what is left of its absolute lifetime.
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var token string
+	err = securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	record, err := userStore.GetSession(hashToken(token))
+	if err == ErrSessionNotFound {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	limit := record.CreatedAt.Add(sessionTimeouts.absolute)
+	remaining := time.Until(limit)
+	if remaining <= 0 {
+		return session, nil
+	}
+	err = gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values)
+	if err != nil {
+		return session, fmt.Errorf("error decoding session: %v", err)
+	}
+	session.ID = token
+	session.IsNew = false
+	session.Options.MaxAge = int(remaining/time.Second) + 1
+
+	// Using the session moves its idle expiry forward
+	ip, userAgent := clientIP(r), r.UserAgent()
+	if time.Since(record.LastSeenAt) > sessionTouchInterval || ip != record.IPAddress || userAgent != record.UserAgent {
+		err = userStore.TouchSession(record.TokenHash, ip, userAgent, sessionExpiry(record.UserID != 0, limit))
+		if err != nil {
+			log.Printf("Error updating session last seen time: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores session's values and sets its cookie, or deletes the session
+// if its MaxAge is negative.
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := userStore.DeleteSessionByToken(hashToken(session.ID))
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(session.Values)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %v", err)
+	}
+	userID, _ := session.Values[sessionUserIDKey].(int)
+	limit := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	record := SessionRecord{UserID: userID, Data: data.Bytes(), ExpiresAt: sessionExpiry(userID != 0, limit)}
+
+	err = ErrSessionNotFound
+	if session.ID != "" {
+		record.TokenHash = hashToken(session.ID)
+		err = userStore.UpdateSession(record)
+	}
+	if err == ErrSessionNotFound {
+		// A new session, or one deleted since it was loaded
+		session.Options.MaxAge = s.Options.MaxAge
+		limit = time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+		record.ExpiresAt = sessionExpiry(userID != 0, limit)
+		session.ID = generateRandomToken(32)
+		record.TokenHash = hashToken(session.ID)
+		record.UserAgent = r.UserAgent()
+		record.IPAddress = clientIP(r)
+		err = userStore.CreateSession(&record)
+	}
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// regenerateSession replaces r's session with a new one under a new token,
+// deleting the old one, so that a token known before a sign-in is worthless
+// after it. Only the values named in carry are copied to the new session;
+// anything else, including whatever a pre-seeded cookie put there, is
+// dropped. The new session is saved by the caller.
+func regenerateSession(r *http.Request, carry ...string) (*sessions.Session, error) {
+	session, _ := store.Get(r, sessionCookieName)
+	if session.ID != "" {
+		err := userStore.DeleteSessionByToken(hashToken(session.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values := make(map[interface{}]interface{})
+	for _, key := range carry {
+		if value, ok := session.Values[key]; ok {
+			values[key] = value
+		}
+	}
+
+	// The session object is the one the request's registry hands out, so
+	// later store.Get calls see the new session too
+	options := *store.Options
+	session.ID = ""
+	session.Values = values
+	session.Options = &options
+	session.IsNew = true
+	return session, nil
+}
+
+// runSessionSweeper deletes expired sessions until ctx is cancelled.
+func runSessionSweeper(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := userStore.DeleteExpiredSessions()
+		if err != nil {
+			log.Printf("Error deleting expired sessions: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired sessions", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionsHandler lists the signed-in user's sessions. The one making the
+// request is marked current.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	views, err := userSessionViews(r, user.ID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// sessionsPageHandler renders the session management page.
+func sessionsPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	views, err := userSessionViews(r, user.ID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+	logins, err := userPersistentLoginViews(r, user.ID)
+	if err != nil {
+		log.Printf("Error listing persistent logins: %v", err)
+		http.Error(w, "Error retrieving remembered devices", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, r, "templates/sessions.html", map[string]interface{}{
+		"Sessions":         views,
+		"PersistentLogins": logins,
+	})
+}
+
+// revokeSessionHandler ends one of the signed-in user's sessions
+// ({"id": 3}). Revoking the current session signs out.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = userStore.DeleteSession(user.ID, body.ID)
+	if err == ErrSessionNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditSessionRevoked, user.ID, user.Username, r, fmt.Sprintf("session %d revoked", body.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// sessionView is a SessionRecord as shown to its user.
+type sessionView struct {
+	SessionRecord
+	Current bool `json:"current"`
+}
+
+// userSessionViews returns the sessions of the user with userID, marking
+// the one r belongs to.
+func userSessionViews(r *http.Request, userID int) ([]sessionView, error) {
+	records, err := userStore.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := currentSessionTokenHash(r)
+	views := make([]sessionView, 0, len(records))
+	for _, record := range records {
+		views = append(views, sessionView{SessionRecord: record, Current: record.TokenHash == current})
+	}
+	return views, nil
+}
+
+// writeUnauthorized answers a request that needs a signed-in user but has
+// none. Browsers loading a page are sent to the sign-in page and other
+// clients get 401; either way, they are told if their session expired.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	expired := sessionExpired(r)
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		target := "/welcome"
+		if expired {
+			target += "?expired=1"
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	if expired {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// sessionExpired reports whether r came with a session cookie for a session
+// that has since expired or been revoked.
+func sessionExpired(r *http.Request) bool {
+	if _, err := r.Cookie(sessionCookieName); err != nil {
+		return false
+	}
+	session, _ := store.Get(r, sessionCookieName)
+	return session.IsNew
+}
+
+// currentSessionTokenHash returns the token hash of r's session, or "" if
+// it has none yet.
+func currentSessionTokenHash(r *http.Request) string {
+	session, _ := store.Get(r, sessionCookieName)
+	if session.ID == "" {
+		return ""
+	}
+	return hashToken(session.ID)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// seedSession makes the session cookie an attacker would plant in a victim's
+// browser: a valid, anonymous session holding a value of their choosing.
+func seedSession(t *testing.T) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(r, sessionCookieName)
+	session.Values["planted"] = "attacker"
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	cookie := responseCookie(w, sessionCookieName)
+	if cookie == nil {
+		t.Fatal("no session cookie set")
+	}
+	return cookie
+}
+
+// sessionValues loads the session a request with cookie would get.
+func sessionValues(cookie *http.Cookie) (map[interface{}]interface{}, bool) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	session, _ := store.Get(r, sessionCookieName)
+	return session.Values, session.IsNew
+}
+
+// assertReplaced checks that after signing in the seeded session is dead,
+// the new one belongs to username, and nothing was carried over.
+func assertReplaced(t *testing.T, seeded, current *http.Cookie, username string) {
+	t.Helper()
+	if current == nil {
+		t.Fatal("sign-in set no session cookie")
+	}
+	if current.Value == seeded.Value {
+		t.Fatal("sign-in kept the seeded session cookie")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(seeded)
+	if user, err := currentUser(r); err == nil {
+		t.Fatalf("seeded cookie is signed in as %s", user.Username)
+	}
+	if values, isNew := sessionValues(seeded); !isNew || len(values) != 0 {
+		t.Fatalf("seeded session still exists with values %v", values)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(current)
+	user, err := currentUser(r)
+	if err != nil || user.Username != username {
+		t.Fatalf("new session: got user %q, err %v; want %s", user.Username, err, username)
+	}
+	if values, _ := sessionValues(current); values["planted"] != nil {
+		t.Fatal("seeded value carried over to the new session")
+	}
+}
+
+func TestSignInReplacesSeededSession(t *testing.T) {
+	setupTestServer(t)
+	createTestUser(t, "alice", "Correct-Horse-77-battery")
+	seeded := seedSession(t)
+
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"Correct-Horse-77-battery"}`, seeded)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("sign-in: got %d %s", w.Code, w.Body)
+	}
+	assertReplaced(t, seeded, responseCookie(w, sessionCookieName), "alice")
+}
+
+func TestTwoFactorSignInReplacesSeededSession(t *testing.T) {
+	setupTestServer(t)
+	user := createTestUser(t, "bob", "Correct-Horse-77-battery")
+	key, err := totpKey(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.SetTOTPSecret(user.ID, key.Secret()); err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.EnableTOTP(user.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	seeded := seedSession(t)
+
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"bob","password":"Correct-Horse-77-battery"}`, seeded)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("sign-in: got %d %s", w.Code, w.Body)
+	}
+	challenge := responseCookie(w, sessionCookieName)
+	if challenge == nil || challenge.Value == seeded.Value {
+		t.Fatal("the two-factor challenge kept the seeded session cookie")
+	}
+	if values, _ := sessionValues(challenge); values["planted"] != nil {
+		t.Fatal("seeded value carried over to the challenge session")
+	}
+
+	code, err := totp.GenerateCodeCustom(key.Secret(), time.Now(), totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(twoFactorChallengeHandler, http.MethodPost, "/signin/2fa", `{"code":"`+code+`"}`, challenge)
+	if w.Code != http.StatusOK {
+		t.Fatalf("two-factor challenge: got %d %s", w.Code, w.Body)
+	}
+	current := responseCookie(w, sessionCookieName)
+	assertReplaced(t, seeded, current, "bob")
+	if current.Value == challenge.Value {
+		t.Fatal("completing the challenge kept the challenge session cookie")
+	}
+	if values, isNew := sessionValues(challenge); !isNew || len(values) != 0 {
+		t.Fatalf("challenge session still exists with values %v", values)
+	}
+}
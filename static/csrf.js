@@ -0,0 +1,25 @@
+// Adds the page's CSRF token, from <meta name="csrf-token">, to every
+// same-origin fetch that isn't a GET or HEAD, so page scripts don't each
+// have to.
+
+(function() {
+    var meta = document.querySelector('meta[name="csrf-token"]');
+    if (!meta) {
+        return;
+    }
+    var token = meta.content;
+    var originalFetch = window.fetch;
+
+    window.fetch = function(input, init) {
+        init = init || {};
+        var request = input instanceof Request ? input : null;
+        var method = (init.method || (request ? request.method : 'GET')).toUpperCase();
+        var url = new URL(request ? request.url : input, window.location.href);
+        if (url.origin === window.location.origin && method !== 'GET' && method !== 'HEAD') {
+            var headers = new Headers(init.headers || (request ? request.headers : {}));
+            headers.set('X-CSRF-Token', token);
+            init.headers = headers;
+        }
+        return originalFetch.call(this, input, init);
+    };
+})();
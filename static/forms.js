@@ -0,0 +1,23 @@
+// Helpers for showing the field errors the server returns with a 422
+// response: {"message": "...", "errors": [{"field", "code", "message"}]}.
+
+function clearFieldErrors(form) {
+    form.querySelectorAll('.field-error').forEach(el => el.remove());
+}
+
+// showFieldErrors puts each error's message under the input with the same
+// name, or at the end of the form if there is none.
+function showFieldErrors(form, errors) {
+    clearFieldErrors(form);
+    errors.forEach(function(error) {
+        var message = document.createElement('div');
+        message.className = 'field-error';
+        message.textContent = error.message;
+        var input = form.querySelector('[name="' + error.field + '"]');
+        if (input) {
+            input.insertAdjacentElement('afterend', message);
+        } else {
+            form.appendChild(message);
+        }
+    });
+}
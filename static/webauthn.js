@@ -0,0 +1,59 @@
+// Helpers for the WebAuthn browser API. The server sends and expects binary
+// fields (challenges, IDs, authenticator data) as base64url strings.
+
+function base64urlToBuffer(value) {
+    var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    var binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+    return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    var binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+// creationOptions decodes the options from /account/passkeys/register/begin
+// for navigator.credentials.create().
+function creationOptions(options) {
+    var publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach(c => c.id = base64urlToBuffer(c.id));
+    return { publicKey: publicKey };
+}
+
+// requestOptions decodes the options from /signin/passkey/begin for
+// navigator.credentials.get().
+function requestOptions(options) {
+    var publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach(c => c.id = base64urlToBuffer(c.id));
+    return { publicKey: publicKey };
+}
+
+// credentialToJSON encodes a PublicKeyCredential from create() or get() for
+// the server.
+function credentialToJSON(credential) {
+    var response = credential.response;
+    var json = {
+        id: credential.id,
+        rawId: bufferToBase64url(credential.rawId),
+        type: credential.type,
+        authenticatorAttachment: credential.authenticatorAttachment,
+        clientExtensionResults: credential.getClientExtensionResults(),
+        response: {
+            clientDataJSON: bufferToBase64url(response.clientDataJSON)
+        }
+    };
+    if (response.attestationObject) {
+        json.response.attestationObject = bufferToBase64url(response.attestationObject);
+        json.response.transports = response.getTransports ? response.getTransports() : [];
+    } else {
+        json.response.authenticatorData = bufferToBase64url(response.authenticatorData);
+        json.response.signature = bufferToBase64url(response.signature);
+        if (response.userHandle) {
+            json.response.userHandle = bufferToBase64url(response.userHandle);
+        }
+    }
+    return json;
+}
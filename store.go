@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUserExists       = errors.New("user already exists")
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityExists   = errors.New("identity already linked")
+	ErrTokenInvalid     = errors.New("token is invalid, expired or already used")
+	ErrCodeInvalid      = errors.New("code is invalid or already used")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	ErrPasskeyExists    = errors.New("passkey already registered")
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrLoginNotFound    = errors.New("persistent login not found")
+	ErrRoleNotFound     = errors.New("role not found")
+)
+
+// UserStore is the persistence layer for user accounts. Handlers go through
+// it rather than the database directly so the backend can be swapped.
+type UserStore interface {
+	// CreateUser inserts user and fills in its ID. An empty Password or
+	// Email is stored as NULL.
+	CreateUser(user *User) error
+	// GetUser resolves a user by username or (case-insensitively) email,
+	// preferring a username match.
+	GetUser(usernameOrEmail string) (User, error)
+	GetUserByID(id int) (User, error)
+	GetUserByMembershipID(membershipID string) (User, error)
+	// GetUserByIdentity resolves the user linked to a provider subject.
+	GetUserByIdentity(provider, subject string) (User, error)
+	ListUsers() ([]User, error)
+	// ListPasswordHashes returns the stored password hash of every user
+	// that has a password.
+	ListPasswordHashes() ([]string, error)
+	// UpdateUser saves the username, email and password of the user with
+	// user.ID. Changing the email clears its verified state.
+	UpdateUser(user User) error
+	// MarkEmailVerified records that the user with userID receives mail at
+	// email. It returns ErrUserNotFound if that is no longer their email.
+	MarkEmailVerified(userID int, email string) error
+	DeleteUser(id int) error
+	// SuspendUser marks the user suspended for reason; ReactivateUser
+	// lifts the suspension. Neither touches the user's sessions.
+	SuspendUser(userID int, reason string) error
+	ReactivateUser(userID int) error
+
+	// CreateIdentity links identity to identity.UserID and fills in its ID.
+	CreateIdentity(identity *Identity) error
+	ListIdentities(userID int) ([]Identity, error)
+	// DeleteIdentity unlinks identity id, which must belong to userID.
+	DeleteIdentity(userID, id int) error
+
+	// InvalidateSessions increments the user's session epoch and deletes
+	// their sessions and persistent logins, ending every session started
+	// before the call.
+	InvalidateSessions(userID int) error
+
+	// CreateSession stores session and fills in its ID.
+	CreateSession(session *SessionRecord) error
+	// GetSession returns the unexpired session with tokenHash, or
+	// ErrSessionNotFound.
+	GetSession(tokenHash string) (SessionRecord, error)
+	// UpdateSession saves the user, data and expiry of the session with
+	// session.TokenHash. It returns ErrSessionNotFound if the session has
+	// been deleted or has expired.
+	UpdateSession(session SessionRecord) error
+	// TouchSession records that the session with tokenHash was just used,
+	// from ipAddress with userAgent, and moves its expiry to expiresAt.
+	TouchSession(tokenHash, ipAddress, userAgent string, expiresAt time.Time) error
+	// ListSessions returns the user's unexpired sessions, most recently
+	// used first.
+	ListSessions(userID int) ([]SessionRecord, error)
+	// DeleteSession ends session id, which must belong to userID.
+	DeleteSession(userID, id int) error
+	// DeleteSessionByToken ends the session with tokenHash, if it exists.
+	DeleteSessionByToken(tokenHash string) error
+	// DeleteExpiredSessions removes expired sessions, persistent logins and
+	// used OAuth states and returns how many there were.
+	DeleteExpiredSessions() (int64, error)
+
+	// CreatePersistentLogin stores login and fills in its ID.
+	CreatePersistentLogin(login *PersistentLogin) error
+	// GetPersistentLogin returns the unexpired persistent login with
+	// tokenHash, or ErrLoginNotFound.
+	GetPersistentLogin(tokenHash string) (PersistentLogin, error)
+	// TouchPersistentLogin records that persistent login id was just used,
+	// from ipAddress with userAgent.
+	TouchPersistentLogin(id int, ipAddress, userAgent string) error
+	// ListPersistentLogins returns the user's unexpired persistent logins,
+	// most recently used first.
+	ListPersistentLogins(userID int) ([]PersistentLogin, error)
+	// DeletePersistentLogin revokes persistent login id, which must belong
+	// to userID.
+	DeletePersistentLogin(userID, id int) error
+	// DeletePersistentLoginByToken revokes the persistent login with
+	// tokenHash, if it exists.
+	DeletePersistentLoginByToken(tokenHash string) error
+
+	// ListUserRoles returns the names of the user's roles, sorted.
+	ListUserRoles(userID int) ([]string, error)
+	// ListUserPermissions returns the permissions the user's roles grant.
+	ListUserPermissions(userID int) ([]string, error)
+	// AssignRole gives the user role, or returns ErrRoleNotFound. Assigning
+	// a role the user already has is not an error.
+	AssignRole(userID int, role string) error
+	// RemoveRole takes role away from the user, if they have it.
+	RemoveRole(userID int, role string) error
+	// CountUsersWithRole returns how many users have role.
+	CountUsersWithRole(role string) (int, error)
+
+	// CreateToken stores token and fills in its ID. Any unconsumed tokens
+	// the user has for the same purpose are discarded, so only the latest
+	// one works.
+	CreateToken(token *AccountToken) error
+	// ConsumeToken atomically marks the unexpired, unused token with
+	// tokenHash and purpose as used and returns it, or ErrTokenInvalid.
+	ConsumeToken(purpose, tokenHash string) (AccountToken, error)
+	// GetToken returns the unexpired, unused token with tokenHash and
+	// purpose without consuming it, or ErrTokenInvalid.
+	GetToken(purpose, tokenHash string) (AccountToken, error)
+	// UseOAuthState records that the OAuth login with stateHash has been
+	// completed, keeping the record until expiresAt. It returns
+	// ErrTokenInvalid if it already was, so each login's callback works once.
+	UseOAuthState(stateHash string, expiresAt time.Time) error
+	// LastTokenCreatedAt returns when the user's most recent token for
+	// purpose was created, or the zero time if there is none.
+	LastTokenCreatedAt(userID int, purpose string) (time.Time, error)
+
+	// SetTOTPSecret starts TOTP enrolment with secret, replacing any
+	// enrolment in progress. Two-factor stays disabled until EnableTOTP.
+	SetTOTPSecret(userID int, secret string) error
+	// EnableTOTP turns on two-factor authentication with the enrolled
+	// secret and replaces the user's recovery codes with recoveryCodeHashes.
+	EnableTOTP(userID int, recoveryCodeHashes []string) error
+	// DisableTOTP turns off two-factor authentication and deletes the
+	// secret and recovery codes.
+	DisableTOTP(userID int) error
+	// UseTOTPStep records that a code for time step was accepted. It
+	// returns ErrCodeInvalid if a code for that or a later step already
+	// was, so each code works once.
+	UseTOTPStep(userID int, step int64) error
+	// ReplaceRecoveryCodes discards the user's recovery codes and stores
+	// new ones.
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used, or returns
+	// ErrCodeInvalid.
+	UseRecoveryCode(userID int, codeHash string) error
+	// CountRecoveryCodes returns how many unused recovery codes the user
+	// has left.
+	CountRecoveryCodes(userID int) (int, error)
+
+	// CreatePasskey stores passkey and fills in its ID. It returns
+	// ErrPasskeyExists if the credential ID is already registered.
+	CreatePasskey(passkey *Passkey) error
+	ListPasskeys(userID int) ([]Passkey, error)
+	// GetPasskeyByCredentialID resolves a passkey by the authenticator's
+	// credential ID.
+	GetPasskeyByCredentialID(credentialID []byte) (Passkey, error)
+	// UpdatePasskeyUsage records a sign-in with passkey id: the new
+	// signature counter and backup state, and the time of use.
+	UpdatePasskeyUsage(id int, signCount uint32, backupState bool) error
+	// RenamePasskey renames passkey id, which must belong to userID.
+	RenamePasskey(userID, id int, name string) error
+	// DeletePasskey removes passkey id, which must belong to userID.
+	DeletePasskey(userID, id int) error
+
+	// ReserveLoginAttempt counts a sign-in attempt for scope and subject as
+	// failed before it is checked, so parallel attempts can't slip past the
+	// throttle. In one step it forgets failures older than window, refuses
+	// the attempt if scope and subject are locked, and otherwise counts it
+	// and locks them for delays[n-1] after the nth failure (the last entry
+	// for any further ones). If they were locked, allowed is false and
+	// throttle is the current record.
+	ReserveLoginAttempt(scope, subject string, window time.Duration, delays []time.Duration) (throttle LoginThrottle, allowed bool, err error)
+	// ReleaseLoginAttempt takes back a reserved attempt that succeeded:
+	// the count goes down by one and the lock follows it, from the time of
+	// the last attempt.
+	ReleaseLoginAttempt(scope, subject string, delays []time.Duration) error
+	// GetLoginThrottle returns the record for scope and subject, or a zero
+	// record if there have been no failures.
+	GetLoginThrottle(scope, subject string) (LoginThrottle, error)
+	// ClearLoginFailures forgets the failures and lock of scope and
+	// subject.
+	ClearLoginFailures(scope, subject string) error
+
+	// RecordAuditEvent stores event and fills in its ID.
+	RecordAuditEvent(event *AuditEvent) error
+}
+
+var userStore UserStore
+
+// initStore selects the storage backend for userStore and mailQueue from
+// STORE_BACKEND. "postgres" (the default) connects to the database and
+// applies migrations; "memory" keeps everything in process memory and needs
+// no infrastructure.
+func initStore() error {
+	backend := os.Getenv("STORE_BACKEND")
+	switch backend {
+	case "", "postgres":
+		log.Println("Initializing database connection...")
+		err := initDB()
+		if err != nil {
+			return fmt.Errorf("error initializing database: %v", err)
+		}
+		pgStore := &postgresStore{db: db}
+		userStore = pgStore
+		mailQueue = pgStore
+	case "memory":
+		log.Println("Using in-memory store; data will be lost on shutdown")
+		memStore := newMemoryStore()
+		userStore = memStore
+		mailQueue = memStore
+	default:
+		return fmt.Errorf("unknown STORE_BACKEND: %s", backend)
+	}
+
+	return nil
+}
+
+func closeStore() {
+	if db != nil {
+		db.Close()
+	}
+}
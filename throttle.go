@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	loginScopeAccount = "account"
+	loginScopeIP      = "ip"
+)
+
+// loginLimits are the failed sign-in thresholds for one scope. After
+// backoffAfter failures each further attempt has to wait, twice as long
+// every time; after lockoutAfter failures the scope is locked.
+type loginLimits struct {
+	backoffAfter int
+	lockoutAfter int
+}
+
+// loginThrottlePolicy decides how failed sign-ins slow down and lock out
+// further attempts, per account and per client address. It is set from the
+// environment by loadLoginThrottlePolicy.
+var loginThrottlePolicy = struct {
+	account     loginLimits
+	ip          loginLimits
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	lockout     time.Duration
+	// window is how long a failure counts; a quiet period this long
+	// starts the count over.
+	window time.Duration
+}{
+	account:     loginLimits{backoffAfter: 3, lockoutAfter: 10},
+	ip:          loginLimits{backoffAfter: 10, lockoutAfter: 100},
+	backoffBase: time.Second,
+	backoffMax:  time.Minute,
+	lockout:     15 * time.Minute,
+	window:      24 * time.Hour,
+}
+
+func loadLoginThrottlePolicy() error {
+	p := &loginThrottlePolicy
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"LOGIN_ACCOUNT_BACKOFF_AFTER", &p.account.backoffAfter},
+		{"LOGIN_ACCOUNT_LOCKOUT_AFTER", &p.account.lockoutAfter},
+		{"LOGIN_IP_BACKOFF_AFTER", &p.ip.backoffAfter},
+		{"LOGIN_IP_LOCKOUT_AFTER", &p.ip.lockoutAfter},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid %s: %s", setting.name, value)
+			}
+			*setting.value = n
+		}
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"LOGIN_BACKOFF_BASE", &p.backoffBase},
+		{"LOGIN_BACKOFF_MAX", &p.backoffMax},
+		{"LOGIN_LOCKOUT_DURATION", &p.lockout},
+		{"LOGIN_FAILURE_WINDOW", &p.window},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s: %s", setting.name, value)
+			}
+			*setting.value = d
+		}
+	}
+
+	log.Printf("Sign-in throttling: account lockout after %d failures, IP lockout after %d, for %s",
+		p.account.lockoutAfter, p.ip.lockoutAfter, p.lockout)
+	return nil
+}
+
+// loginDelay returns how long to refuse attempts after the given number of
+// failures, and whether that is a lockout rather than a backoff.
+func loginDelay(limits loginLimits, failures int) (time.Duration, bool) {
+	p := loginThrottlePolicy
+	if failures >= limits.lockoutAfter {
+		return p.lockout, true
+	}
+	if failures < limits.backoffAfter {
+		return 0, false
+	}
+
+	delay := p.backoffBase
+	for i := limits.backoffAfter; i < failures && delay < p.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > p.backoffMax {
+		delay = p.backoffMax
+	}
+	return delay, false
+}
+
+// loginDelays returns the delay after each number of failures, up to the
+// lockout, for ReserveLoginAttempt.
+func loginDelays(limits loginLimits) []time.Duration {
+	delays := make([]time.Duration, limits.lockoutAfter)
+	for i := range delays {
+		delays[i], _ = loginDelay(limits, i+1)
+	}
+	return delays
+}
+
+// checkLoginAllowed reports whether a sign-in attempt from r, for user if
+// known, may go ahead. If not, it writes a 429 response with Retry-After.
+// It is called before the password is checked, so throttled guesses don't
+// cost a hash comparison, and it counts the attempt as failed right away,
+// so guesses sent in parallel are throttled like ones sent in turn.
+// recordLoginSuccess takes the attempt back.
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, user *User) bool {
+	p := loginThrottlePolicy
+	ip := clientIP(r)
+	throttle, allowed, err := userStore.ReserveLoginAttempt(loginScopeIP, ip, p.window, loginDelays(p.ip))
+	if err == nil && allowed && user != nil {
+		throttle, allowed, err = userStore.ReserveLoginAttempt(loginScopeAccount, strconv.Itoa(user.ID), p.window, loginDelays(p.account))
+		if err != nil || !allowed {
+			releaseLoginAttempt(r, nil)
+		}
+	}
+	if err != nil {
+		log.Printf("Error checking sign-in throttle: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		wait := time.Until(throttle.LockedUntil)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed sign-in attempts; please try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure records a lockout caused by the failed attempt from r
+// for the client address and, if known, the account. checkLoginAllowed has
+// already counted the failure and backed off or locked them.
+func recordLoginFailure(r *http.Request, user *User) {
+	auditLockout(r, loginScopeIP, clientIP(r), 0, loginThrottlePolicy.ip)
+	if user != nil {
+		auditLockout(r, loginScopeAccount, strconv.Itoa(user.ID), user.ID, loginThrottlePolicy.account)
+	}
+}
+
+func auditLockout(r *http.Request, scope, subject string, userID int, limits loginLimits) {
+	throttle, err := userStore.GetLoginThrottle(scope, subject)
+	if err != nil {
+		log.Printf("Error checking sign-in lockout: %v", err)
+		return
+	}
+	if throttle.Failures < limits.lockoutAfter {
+		return
+	}
+
+	eventType := auditAccountLocked
+	if scope == loginScopeIP {
+		eventType = auditIPLocked
+	}
+	recordAudit(eventType, userID, "system", r,
+		fmt.Sprintf("%s %s locked until %s after %d failed sign-in attempts", scope, subject, throttle.LockedUntil.Format(time.RFC3339), throttle.Failures))
+}
+
+// releaseLoginAttempt gives the client address and, if known, the account
+// back the attempt that checkLoginAllowed counted, once its password or
+// code was accepted.
+func releaseLoginAttempt(r *http.Request, user *User) {
+	err := userStore.ReleaseLoginAttempt(loginScopeIP, clientIP(r), loginDelays(loginThrottlePolicy.ip))
+	if err == nil && user != nil {
+		err = userStore.ReleaseLoginAttempt(loginScopeAccount, strconv.Itoa(user.ID), loginDelays(loginThrottlePolicy.account))
+	}
+	if err != nil {
+		log.Printf("Error releasing sign-in attempt from %s: %v", clientIP(r), err)
+	}
+}
+
+// recordLoginSuccess clears the account's failures and takes back the
+// attempt counted against the client address. The address keeps its other
+// failures, so signing in to one account doesn't reset guessing at others.
+func recordLoginSuccess(r *http.Request, user User) {
+	releaseLoginAttempt(r, nil)
+	err := userStore.ClearLoginFailures(loginScopeAccount, strconv.Itoa(user.ID))
+	if err != nil {
+		log.Printf("Error clearing failed sign-ins for %s: %v", user.Username, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useLoginThrottlePolicy loads the sign-in throttle policy with env set,
+// and puts the previous policy back when the test ends.
+func useLoginThrottlePolicy(t *testing.T, env map[string]string) {
+	t.Helper()
+	previous := loginThrottlePolicy
+	t.Cleanup(func() { loginThrottlePolicy = previous })
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	if err := loadLoginThrottlePolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signInStatus(username, password string) int {
+	return serve(signinHandler, http.MethodPost, "/signin", `{"username":"`+username+`","password":"`+password+`"}`).Code
+}
+
+func TestLoginDelay(t *testing.T) {
+	useLoginThrottlePolicy(t, map[string]string{"LOGIN_BACKOFF_BASE": "1s", "LOGIN_BACKOFF_MAX": "10s", "LOGIN_LOCKOUT_DURATION": "15m"})
+	limits := loginLimits{backoffAfter: 3, lockoutAfter: 10}
+
+	for _, test := range []struct {
+		failures int
+		delay    time.Duration
+		lockout  bool
+	}{
+		{0, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{6, 8 * time.Second, false},
+		{7, 10 * time.Second, false}, // capped at LOGIN_BACKOFF_MAX
+		{10, 15 * time.Minute, true},
+		{12, 15 * time.Minute, true},
+	} {
+		delay, lockout := loginDelay(limits, test.failures)
+		if delay != test.delay || lockout != test.lockout {
+			t.Errorf("%d failures: got %s, lockout %v; want %s, lockout %v", test.failures, delay, lockout, test.delay, test.lockout)
+		}
+	}
+
+	delays := loginDelays(limits)
+	if len(delays) != 10 || delays[2] != time.Second || delays[9] != 15*time.Minute {
+		t.Fatalf("got delays %v", delays)
+	}
+}
+
+func TestSignInThrottle(t *testing.T) {
+	setupTestServer(t)
+	useTestHasher(t, "argon2id")
+	useLoginThrottlePolicy(t, map[string]string{
+		"LOGIN_ACCOUNT_BACKOFF_AFTER": "100",
+		"LOGIN_ACCOUNT_LOCKOUT_AFTER": "3",
+		"LOGIN_IP_BACKOFF_AFTER":      "100",
+		"LOGIN_IP_LOCKOUT_AFTER":      "6",
+	})
+	alice := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	createTestUser(t, "bob", "Correct-Horse-77-battery")
+
+	// A success clears the account's failures
+	for i := 0; i < 2; i++ {
+		if got := signInStatus("alice", "wrong-password"); got != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: got %d", i+1, got)
+		}
+	}
+	if got := signInStatus("alice", "Correct-Horse-77-battery"); got != http.StatusSeeOther {
+		t.Fatalf("right password: got %d", got)
+	}
+	if throttle, _ := userStore.GetLoginThrottle(loginScopeAccount, strconv.Itoa(alice.ID)); throttle.Failures != 0 {
+		t.Fatalf("account has %d failures after signing in", throttle.Failures)
+	}
+
+	// The third failure locks the account, even against the right password
+	for i := 0; i < 3; i++ {
+		signInStatus("alice", "wrong-password")
+	}
+	w := serve(signinHandler, http.MethodPost, "/signin", `{"username":"alice","password":"Correct-Horse-77-battery"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked account: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	locked := false
+	for _, event := range userStore.(*memoryStore).auditEvents {
+		locked = locked || (event.Type == auditAccountLocked && event.UserID == alice.ID)
+	}
+	if !locked {
+		t.Fatal("lockout wasn't audited")
+	}
+
+	// The address has five failures and the refused attempt didn't count;
+	// signing in to another account doesn't add to them
+	if got := signInStatus("bob", "Correct-Horse-77-battery"); got != http.StatusSeeOther {
+		t.Fatalf("other account: got %d", got)
+	}
+	if got := signInStatus("nobody", "wrong-password"); got != http.StatusUnauthorized {
+		t.Fatalf("unknown user: got %d", got)
+	}
+	if got := signInStatus("bob", "Correct-Horse-77-battery"); got != http.StatusTooManyRequests {
+		t.Fatalf("locked address: got %d", got)
+	}
+
+	// An admin unlock lets the account sign in again
+	userStore.ClearLoginFailures(loginScopeIP, "192.0.2.1")
+	userStore.ClearLoginFailures(loginScopeAccount, strconv.Itoa(alice.ID))
+	if got := signInStatus("alice", "Correct-Horse-77-battery"); got != http.StatusSeeOther {
+		t.Fatalf("after unlocking: got %d", got)
+	}
+}
+
+func TestSignInThrottleParallelGuesses(t *testing.T) {
+	setupTestServer(t)
+	useTestHasher(t, "argon2id")
+	useLoginThrottlePolicy(t, map[string]string{
+		"LOGIN_ACCOUNT_BACKOFF_AFTER": "100",
+		"LOGIN_ACCOUNT_LOCKOUT_AFTER": "3",
+		"LOGIN_IP_BACKOFF_AFTER":      "100",
+		"LOGIN_IP_LOCKOUT_AFTER":      "100",
+	})
+	createTestUser(t, "alice", "Correct-Horse-77-battery")
+
+	const guesses = 20
+	codes := make(chan int, guesses)
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- signInStatus("alice", "wrong-password")
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusUnauthorized] != 3 || counts[http.StatusTooManyRequests] != guesses-3 {
+		t.Fatalf("got %v, want 3 checked guesses and the rest refused", counts)
+	}
+}
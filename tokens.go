@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	tokenPurposePasswordReset     = "password_reset"
+	tokenPurposeEmailVerification = "email_verification"
+)
+
+// hashToken returns the hex SHA-256 of a token secret, which is what the
+// store keeps. Secrets are long and random, so a plain hash is enough.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAccountToken creates a token for userID, to be sent to email, valid
+// for ttl and returns the secret to send to the user.
+func issueAccountToken(userID int, purpose, email string, ttl time.Duration) (string, error) {
+	secret := generateRandomToken(32)
+	token := AccountToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(secret),
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err := userStore.CreateToken(&token)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// redeemAccountToken consumes the token with secret, returning
+// ErrTokenInvalid if it is unknown, expired or already used.
+func redeemAccountToken(purpose, secret string) (AccountToken, error) {
+	if secret == "" {
+		return AccountToken{}, ErrTokenInvalid
+	}
+	return userStore.ConsumeToken(purpose, hashToken(secret))
+}
+
+// lookupAccountToken is redeemAccountToken without consuming the token, for
+// checking a request before acting on it.
+func lookupAccountToken(purpose, secret string) (AccountToken, error) {
+	if secret == "" {
+		return AccountToken{}, ErrTokenInvalid
+	}
+	return userStore.GetToken(purpose, hashToken(secret))
+}
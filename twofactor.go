@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpPeriod = 30
+	// totpSkew is how many time steps of clock drift either side of now
+	// are accepted.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// twoFactorChallengeTTL is how long a user has to enter their code
+	// after the password was accepted.
+	twoFactorChallengeTTL = 5 * time.Minute
+	// twoFactorMaxAttempts is how many wrong codes end the challenge; the
+	// user has to sign in with their password again.
+	twoFactorMaxAttempts = 5
+)
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Sign-Up Flow"
+}
+
+// totpKey returns the key for user's TOTP secret, or a new random key when
+// secret is empty.
+func totpKey(user User, secret string) (*otp.Key, error) {
+	opts := totp.GenerateOpts{
+		Issuer:      totpIssuer(),
+		AccountName: user.Username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	}
+	if secret != "" {
+		raw, err := totpSecretEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding TOTP secret: %v", err)
+		}
+		opts.Secret = raw
+	}
+	return totp.Generate(opts)
+}
+
+// checkTOTP accepts a current code for user's secret, allowing totpSkew
+// steps of clock drift. Each code is accepted only once.
+func checkTOTP(user User, code string) error {
+	if user.TOTPSecret == "" {
+		return ErrCodeInvalid
+	}
+
+	now := time.Now()
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		t := now.Add(time.Duration(offset*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, t, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return fmt.Errorf("error generating TOTP code: %v", err)
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return userStore.UseTOTPStep(user.ID, t.Unix()/totpPeriod)
+		}
+	}
+	return ErrCodeInvalid
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+func checkSecondFactor(user User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == 6 && strings.Trim(code, "0123456789") == "" {
+		return checkTOTP(user, code)
+	}
+	return userStore.UseRecoveryCode(user.ID, hashToken(normalizeRecoveryCode(code)))
+}
+
+// generateRecoveryCodes returns new recovery codes to show the user and
+// their hashes to store. Codes are ten base32 characters, shown as
+// xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, []string) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		rand.Read(b)
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// beginSignIn completes a password or provider sign-in. Users without two
+// factor authentication are signed in right away. For the others a pending
+// challenge is saved in the session and true is returned: the caller must
+// send them to /signin/2fa, after which they land on returnTo. With
+// remember, the browser also gets a persistent login once signed in.
+func beginSignIn(w http.ResponseWriter, r *http.Request, user User, returnTo string, remember bool) (bool, error) {
+	if !user.TwoFactorEnabled {
+		err := startSession(w, r, user)
+		if err == nil && remember {
+			err = rememberSignIn(w, r, user)
+		}
+		return false, err
+	}
+
+	// The password has been checked, so the challenge gets a fresh session
+	// too
+	session, err := regenerateSession(r)
+	if err != nil {
+		return false, err
+	}
+	session.Values["mfa_membership_id"] = user.MembershipID
+	session.Values["mfa_expires"] = time.Now().Add(twoFactorChallengeTTL).Unix()
+	session.Values["mfa_attempts"] = 0
+	session.Values["mfa_return_to"] = safeReturnURL(returnTo)
+	session.Values["mfa_remember"] = remember
+	return true, session.Save(r, w)
+}
+
+func clearTwoFactorChallenge(w http.ResponseWriter, r *http.Request) error {
+	session, _ := store.Get(r, sessionCookieName)
+	for _, key := range []string{"mfa_membership_id", "mfa_expires", "mfa_attempts", "mfa_return_to", "mfa_remember"} {
+		delete(session.Values, key)
+	}
+	return session.Save(r, w)
+}
+
+// twoFactorChallengeHandler shows the code form (GET) and finishes a
+// pending sign-in with a TOTP or recovery code (POST).
+func twoFactorChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionCookieName)
+	membershipID, _ := session.Values["mfa_membership_id"].(string)
+	expires, _ := session.Values["mfa_expires"].(int64)
+	if membershipID == "" || time.Now().Unix() > expires {
+		http.Error(w, "No sign-in is waiting for a code; please sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "templates/2fa_challenge.html", nil)
+	case http.MethodPost:
+		var body struct {
+			Code string `json:"code"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := userStore.GetUserByMembershipID(membershipID)
+		if err != nil {
+			clearTwoFactorChallenge(w, r)
+			http.Error(w, "No sign-in is waiting for a code; please sign in again", http.StatusUnauthorized)
+			return
+		}
+		if accountSuspended(user) {
+			clearTwoFactorChallenge(w, r)
+			http.Error(w, suspendedMessage, http.StatusForbidden)
+			return
+		}
+		// Codes are throttled like passwords, so signing in again for a
+		// fresh challenge doesn't give more guesses
+		if !checkLoginAllowed(w, r, &user) {
+			return
+		}
+
+		err = checkSecondFactor(user, body.Code)
+		if err == ErrCodeInvalid {
+			attempts, _ := session.Values["mfa_attempts"].(int)
+			attempts++
+			log.Printf("Invalid two-factor code for user %s (attempt %d)", user.Username, attempts)
+			recordLoginFailure(r, &user)
+			if attempts >= twoFactorMaxAttempts {
+				clearTwoFactorChallenge(w, r)
+				http.Error(w, "Too many invalid codes; please sign in again", http.StatusUnauthorized)
+				return
+			}
+			session.Values["mfa_attempts"] = attempts
+			session.Save(r, w)
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking two-factor code: %v", err)
+			http.Error(w, "Error checking code", http.StatusInternalServerError)
+			return
+		}
+
+		recordLoginSuccess(r, user)
+
+		returnTo, _ := session.Values["mfa_return_to"].(string)
+		remember, _ := session.Values["mfa_remember"].(bool)
+		clearTwoFactorChallenge(w, r)
+		err = startSession(w, r, user)
+		if err == nil && remember {
+			err = rememberSignIn(w, r, user)
+		}
+		if err != nil {
+			http.Error(w, "Error creating session", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User %s passed two-factor authentication", user.Username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":  "Sign in successful",
+			"redirect": safeReturnURL(returnTo),
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// twoFactorPageHandler shows the two-factor settings of the signed-in user.
+func twoFactorPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+
+	remaining, err := userStore.CountRecoveryCodes(user.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, r, "templates/2fa.html", struct {
+		Enabled            bool
+		RecoveryCodesLeft  int
+		RecoveryCodesTotal int
+	}{
+		Enabled:            user.TwoFactorEnabled,
+		RecoveryCodesLeft:  remaining,
+		RecoveryCodesTotal: recoveryCodeCount,
+	})
+}
+
+// twoFactorSetupHandler starts enrolment: it generates a new secret and
+// returns it with its otpauth:// URI. The QR code of the URI is served by
+// twoFactorQRHandler.
+func twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	key, err := totpKey(user, "")
+	if err != nil {
+		log.Printf("Error generating TOTP key: %v", err)
+		http.Error(w, "Error starting two-factor setup", http.StatusInternalServerError)
+		return
+	}
+
+	err = userStore.SetTOTPSecret(user.ID, key.Secret())
+	if err != nil {
+		log.Printf("Error saving TOTP secret: %v", err)
+		http.Error(w, "Error starting two-factor setup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      key.Secret(),
+		"otpauth_url": key.URL(),
+		"qr_code_url": "/account/2fa/qr",
+	})
+}
+
+// twoFactorQRHandler serves the QR code of the otpauth:// URI of an
+// enrolment in progress.
+func twoFactorQRHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret == "" || user.TwoFactorEnabled {
+		http.Error(w, "No two-factor setup in progress", http.StatusNotFound)
+		return
+	}
+
+	key, err := totpKey(user, user.TOTPSecret)
+	if err != nil {
+		log.Printf("Error loading TOTP key: %v", err)
+		http.Error(w, "Error generating QR code", http.StatusInternalServerError)
+		return
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		log.Printf("Error generating QR code: %v", err)
+		http.Error(w, "Error generating QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	png.Encode(w, img)
+}
+
+// twoFactorEnableHandler finishes enrolment once the user enters a code
+// from their authenticator, and returns their recovery codes. This is the
+// only time the codes are shown.
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "No two-factor setup in progress", http.StatusBadRequest)
+		return
+	}
+
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+
+	err := checkTOTP(user, code)
+	if err == ErrCodeInvalid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking TOTP code: %v", err)
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	err = userStore.EnableTOTP(user.ID, hashes)
+	if err != nil {
+		log.Printf("Error enabling TOTP: %v", err)
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication enabled for user %s", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// twoFactorDisableHandler turns two-factor authentication off. It takes a
+// TOTP or recovery code so a hijacked session alone can't do it.
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	if !user.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+
+	// Codes are guessable through a stolen session, so wrong ones count
+	// like failed sign-ins
+	if !checkLoginAllowed(w, r, &user) {
+		return
+	}
+	err := checkSecondFactor(user, code)
+	if err == ErrCodeInvalid {
+		recordLoginFailure(r, &user)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking two-factor code: %v", err)
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	recordLoginSuccess(r, user)
+
+	err = userStore.DisableTOTP(user.ID)
+	if err != nil {
+		log.Printf("Error disabling TOTP: %v", err)
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication disabled for user %s", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// recoveryCodesHandler replaces the user's recovery codes with new ones.
+// It takes a TOTP code, so it can't be done with a leaked recovery code.
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireVerifiedUser(w, r)
+	if !ok {
+		return
+	}
+	if !user.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkLoginAllowed(w, r, &user) {
+		return
+	}
+	err := checkTOTP(user, code)
+	if err == ErrCodeInvalid {
+		recordLoginFailure(r, &user)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking TOTP code: %v", err)
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+	recordLoginSuccess(r, user)
+
+	codes, hashes := generateRecoveryCodes()
+	err = userStore.ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		log.Printf("Error replacing recovery codes: %v", err)
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Recovery codes regenerated for user %s", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "New recovery codes generated; the old ones no longer work",
+		"recovery_codes": codes,
+	})
+}
+
+// decodeCode reads {"code": "..."} from the request body.
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if body.Code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return "", false
+	}
+	return strings.TrimSpace(body.Code), true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// enableTestTOTP turns on two-factor authentication for user and returns
+// its secret and recovery codes.
+func enableTestTOTP(t *testing.T, user User) (*otp.Key, []string) {
+	t.Helper()
+	key, err := totpKey(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes := generateRecoveryCodes()
+	if err := userStore.SetTOTPSecret(user.ID, key.Secret()); err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.EnableTOTP(user.ID, hashes); err != nil {
+		t.Fatal(err)
+	}
+	return key, codes
+}
+
+func totpCode(t *testing.T, key *otp.Key) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(key.Secret(), time.Now(), totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// wrongTOTPCode returns a six-digit code that key doesn't accept now, even
+// allowing for clock skew.
+func wrongTOTPCode(t *testing.T, key *otp.Key) string {
+	t.Helper()
+	for n := 100000; ; n++ {
+		wrong := strconv.Itoa(n)
+		valid, err := totp.ValidateCustom(wrong, key.Secret(), time.Now(), totp.ValidateOpts{Period: totpPeriod, Skew: 1, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			return wrong
+		}
+	}
+}
+
+func TestTwoFactorDisable(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		recovery bool
+	}{
+		{"with a TOTP code", false},
+		{"with a recovery code", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestServer(t)
+			user := createTestUser(t, "alice", "Correct-Horse-77-battery")
+			cookie := signIn(t, "alice", "Correct-Horse-77-battery")
+			key, recoveryCodes := enableTestTOTP(t, user)
+
+			for _, wrong := range []string{wrongTOTPCode(t, key), "aaaaa-bbbbb"} {
+				if w := serve(twoFactorDisableHandler, http.MethodPost, "/account/2fa/disable", `{"code":"`+wrong+`"}`, cookie); w.Code != http.StatusUnauthorized {
+					t.Fatalf("wrong code %s: got %d %s", wrong, w.Code, w.Body)
+				}
+			}
+			code := totpCode(t, key)
+			if test.recovery {
+				code = recoveryCodes[0]
+			}
+			if w := serve(twoFactorDisableHandler, http.MethodPost, "/account/2fa/disable", `{"code":"`+code+`"}`, cookie); w.Code != http.StatusOK {
+				t.Fatalf("right code: got %d %s", w.Code, w.Body)
+			}
+			if stored, _ := userStore.GetUserByID(user.ID); stored.TwoFactorEnabled {
+				t.Fatal("two-factor authentication still enabled")
+			}
+			if throttle, _ := userStore.GetLoginThrottle(loginScopeAccount, strconv.Itoa(user.ID)); throttle.Failures != 0 {
+				t.Fatalf("account has %d failures after the right code", throttle.Failures)
+			}
+		})
+	}
+}
+
+func TestTwoFactorCodesAreThrottled(t *testing.T) {
+	useLoginThrottlePolicy(t, map[string]string{
+		"LOGIN_ACCOUNT_BACKOFF_AFTER": "100",
+		"LOGIN_ACCOUNT_LOCKOUT_AFTER": "3",
+	})
+
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+	}{
+		{"disable", twoFactorDisableHandler, "/account/2fa/disable"},
+		{"recovery codes", recoveryCodesHandler, "/account/2fa/recovery-codes"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestServer(t)
+			user := createTestUser(t, "alice", "Correct-Horse-77-battery")
+			cookie := signIn(t, "alice", "Correct-Horse-77-battery")
+			key, _ := enableTestTOTP(t, user)
+
+			for i := 0; i < 3; i++ {
+				if w := serve(test.handler, http.MethodPost, test.target, `{"code":"`+wrongTOTPCode(t, key)+`"}`, cookie); w.Code != http.StatusUnauthorized {
+					t.Fatalf("wrong code %d: got %d %s", i+1, w.Code, w.Body)
+				}
+			}
+			w := serve(test.handler, http.MethodPost, test.target, `{"code":"`+totpCode(t, key)+`"}`, cookie)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("right code after the lockout: got %d, want 429", w.Code)
+			}
+			if stored, _ := userStore.GetUserByID(user.ID); !stored.TwoFactorEnabled {
+				t.Fatal("two-factor authentication changed while locked")
+			}
+		})
+	}
+}
+
+func TestRecoveryCodesHandler(t *testing.T) {
+	setupTestServer(t)
+	user := createTestUser(t, "alice", "Correct-Horse-77-battery")
+	cookie := signIn(t, "alice", "Correct-Horse-77-battery")
+	key, oldCodes := enableTestTOTP(t, user)
+
+	// A leaked recovery code can't be used to make new ones
+	if w := serve(recoveryCodesHandler, http.MethodPost, "/account/2fa/recovery-codes", `{"code":"`+oldCodes[0]+`"}`, cookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("recovery code: got %d %s", w.Code, w.Body)
+	}
+
+	w := serve(recoveryCodesHandler, http.MethodPost, "/account/2fa/recovery-codes", `{"code":"`+totpCode(t, key)+`"}`, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("TOTP code: got %d %s", w.Code, w.Body)
+	}
+	var body struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(body.RecoveryCodes))
+	}
+	if err := checkSecondFactor(user, oldCodes[1]); err != ErrCodeInvalid {
+		t.Fatalf("old recovery code: got %v, want ErrCodeInvalid", err)
+	}
+	if err := checkSecondFactor(user, body.RecoveryCodes[0]); err != nil {
+		t.Fatalf("new recovery code: %v", err)
+	}
+}
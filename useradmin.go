@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// suspendedMessage answers a sign-in to a suspended account.
+const suspendedMessage = "This account has been suspended"
+
+// accountSuspended reports whether an admin has suspended user.
+func accountSuspended(user User) bool {
+	return user.SuspendedAt != nil
+}
+
+// adminUserView is a user as shown to admins, with what they need to
+// decide on an action and without secrets.
+type adminUserView struct {
+	ID               int        `json:"id"`
+	MembershipID     string     `json:"membership_id"`
+	Username         string     `json:"username"`
+	Email            string     `json:"email,omitempty"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at,omitempty"`
+	HasPassword      bool       `json:"has_password"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	Roles            []string   `json:"roles"`
+	Providers        []string   `json:"providers"`
+	Passkeys         int        `json:"passkeys"`
+	Sessions         int        `json:"sessions"`
+}
+
+// adminUserHandler shows one user (/admin/users/view?username=...).
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := userStore.GetUser(r.URL.Query().Get("username"))
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	view, err := newAdminUserView(user)
+	if err != nil {
+		log.Printf("Error getting details of user %s: %v", user.Username, err)
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+func newAdminUserView(user User) (adminUserView, error) {
+	view := adminUserView{
+		ID:               user.ID,
+		MembershipID:     user.MembershipID,
+		Username:         user.Username,
+		Email:            user.Email,
+		EmailVerifiedAt:  user.EmailVerifiedAt,
+		HasPassword:      user.Password != "",
+		TwoFactorEnabled: user.TwoFactorEnabled,
+		SuspendedAt:      user.SuspendedAt,
+		SuspensionReason: user.SuspensionReason,
+		Roles:            []string{},
+		Providers:        []string{},
+	}
+
+	roles, err := userStore.ListUserRoles(user.ID)
+	if err != nil {
+		return adminUserView{}, err
+	}
+	view.Roles = append(view.Roles, roles...)
+
+	identities, err := userStore.ListIdentities(user.ID)
+	if err != nil {
+		return adminUserView{}, err
+	}
+	for _, identity := range identities {
+		view.Providers = append(view.Providers, identity.Provider)
+	}
+
+	passkeys, err := userStore.ListPasskeys(user.ID)
+	if err != nil {
+		return adminUserView{}, err
+	}
+	view.Passkeys = len(passkeys)
+
+	sessions, err := userStore.ListSessions(user.ID)
+	if err != nil {
+		return adminUserView{}, err
+	}
+	view.Sessions = len(sessions)
+	return view, nil
+}
+
+// decodeUserAction reads the body of a user management action,
+// {"username": "...", "reason": "..."}, and looks the user up. Every action
+// needs a reason, which goes into the audit log with the admin's name. It
+// writes the error response itself.
+func decodeUserAction(w http.ResponseWriter, r *http.Request) (User, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return User{}, "", false
+	}
+
+	var body struct {
+		Username string `json:"username"`
+		Reason   string `json:"reason"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return User{}, "", false
+	}
+	reason := strings.TrimSpace(body.Reason)
+	if reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return User{}, "", false
+	}
+
+	user, err := userStore.GetUser(body.Username)
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return User{}, "", false
+	}
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return User{}, "", false
+	}
+	return user, reason, true
+}
+
+// refuseAdminLockout refuses to suspend or delete the admin's own account
+// or the last admin, so that someone is always left to undo it. It writes
+// the error response itself.
+func refuseAdminLockout(w http.ResponseWriter, r *http.Request, user User) bool {
+	if user.ID == requestUser(r).ID {
+		http.Error(w, "You can't do this to your own account", http.StatusConflict)
+		return true
+	}
+	last, err := isLastAdmin(user)
+	if err != nil {
+		log.Printf("Error checking admins: %v", err)
+		http.Error(w, "Error checking admins", http.StatusInternalServerError)
+		return true
+	}
+	if last {
+		http.Error(w, "You can't do this to the last admin", http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// suspendUserHandler suspends an account and signs it out everywhere. It
+// can't sign in again until it is reactivated.
+func suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, reason, ok := decodeUserAction(w, r)
+	if !ok || refuseAdminLockout(w, r, user) {
+		return
+	}
+
+	err := userStore.SuspendUser(user.ID, reason)
+	if err == nil {
+		err = userStore.InvalidateSessions(user.ID)
+	}
+	if err != nil {
+		log.Printf("Error suspending user %s: %v", user.Username, err)
+		http.Error(w, "Error suspending user", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditAccountSuspended, user.ID, requestUser(r).Username, r, fmt.Sprintf("account %s suspended and signed out: %s", user.Username, reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User suspended"})
+}
+
+// reactivateUserHandler lifts a suspension.
+func reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, reason, ok := decodeUserAction(w, r)
+	if !ok {
+		return
+	}
+	if !accountSuspended(user) {
+		http.Error(w, "User is not suspended", http.StatusConflict)
+		return
+	}
+
+	err := userStore.ReactivateUser(user.ID)
+	if err != nil {
+		log.Printf("Error reactivating user %s: %v", user.Username, err)
+		http.Error(w, "Error reactivating user", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditAccountReactivated, user.ID, requestUser(r).Username, r, fmt.Sprintf("account %s reactivated: %s", user.Username, reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User reactivated"})
+}
+
+// forcePasswordResetHandler removes an account's password, signs it out
+// everywhere and mails it a reset link. Until the link is used, the account
+// can only sign in with a linked provider or a passkey.
+func forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, reason, ok := decodeUserAction(w, r)
+	if !ok {
+		return
+	}
+	if user.Email == "" {
+		http.Error(w, "User has no email address to send a reset link to", http.StatusConflict)
+		return
+	}
+
+	user.Password = ""
+	err := userStore.UpdateUser(user)
+	if err == nil {
+		err = userStore.InvalidateSessions(user.ID)
+	}
+	if err != nil {
+		log.Printf("Error removing password of user %s: %v", user.Username, err)
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditPasswordResetForced, user.ID, requestUser(r).Username, r, fmt.Sprintf("password of %s removed, sessions ended and reset link sent: %s", user.Username, reason))
+
+	err = mailPasswordReset(user)
+	if err != nil {
+		log.Printf("Error sending password reset email: %v", err)
+		http.Error(w, "Password removed, but the reset link couldn't be sent; the user can ask for another", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password removed and reset link sent"})
+}
+
+// removeTwoFactorHandler turns off an account's TOTP two-factor
+// authentication and deletes its recovery codes, for a user who has lost
+// both. Passkeys are left alone.
+func removeTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, reason, ok := decodeUserAction(w, r)
+	if !ok {
+		return
+	}
+	if !user.TwoFactorEnabled && user.TOTPSecret == "" {
+		http.Error(w, "User doesn't have two-factor authentication", http.StatusConflict)
+		return
+	}
+
+	err := userStore.DisableTOTP(user.ID)
+	if err != nil {
+		log.Printf("Error removing two-factor authentication of user %s: %v", user.Username, err)
+		http.Error(w, "Error removing two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditTwoFactorRemoved, user.ID, requestUser(r).Username, r, fmt.Sprintf("two-factor authentication of %s removed: %s", user.Username, reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication removed"})
+}
+
+// deleteUserHandler deletes an account with its identities, passkeys,
+// sessions and roles. Its audit events stay, without the user.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, reason, ok := decodeUserAction(w, r)
+	if !ok || refuseAdminLockout(w, r, user) {
+		return
+	}
+
+	err := userStore.DeleteUser(user.ID)
+	if err != nil {
+		log.Printf("Error deleting user %s: %v", user.Username, err)
+		http.Error(w, "Error deleting user", http.StatusInternalServerError)
+		return
+	}
+	// The user is gone, so the event names the account in its details
+	recordAudit(auditAccountDeleted, 0, requestUser(r).Username, r, fmt.Sprintf("account %s (membership ID %s) deleted: %s", user.Username, user.MembershipID, reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted"})
+}
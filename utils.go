@@ -1,11 +1,15 @@
 package main
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -13,16 +17,6 @@ var (
 	randGen    = rand.New(randSource)
 )
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
-
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
-
 func generateMembershipID() string {
 	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	const length = 16
@@ -55,9 +49,90 @@ func isValidMembershipID(id string) bool {
 	}
 	return true
 }
+
+// generateRandomToken returns n bytes from crypto/rand, base64url encoded.
+func generateRandomToken(n int) string {
+	b := make([]byte, n)
+	cryptorand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 func maskString(s string) string {
 	if len(s) <= 4 {
 		return "****"
 	}
 	return s[:2] + strings.Repeat("*", len(s)-4) + s[len(s)-2:]
 }
+
+// splitList splits a comma or whitespace separated list, dropping empty
+// entries.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// publicURL returns the absolute URL of path on this server, based on
+// PUBLIC_BASE_URL.
+func publicURL(path string) string {
+	baseURL := os.Getenv("PUBLIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return strings.TrimSuffix(baseURL, "/") + path
+}
+
+// clientIP returns the address of the client that made r. Behind a reverse
+// proxy, set TRUST_PROXY_HEADERS=true to use the last X-Forwarded-For entry,
+// which is the one the proxy added; earlier entries can be forged.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		forwarded := splitList(r.Header.Get("X-Forwarded-For"))
+		if len(forwarded) > 0 {
+			return forwarded[len(forwarded)-1]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// FieldError is a problem with one field of a submitted form, for the page
+// to show next to that field. Code is stable; Message is for people.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeFieldErrors responds 422 with errs as
+// {"message": "...", "errors": [{"field", "code", "message"}, ...]}.
+func writeFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Please correct the highlighted fields",
+		"errors":  errs,
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// emailVerificationTTL is how long a verification link stays valid.
+	emailVerificationTTL = 24 * time.Hour
+	// verificationResendInterval is the minimum time between two
+	// verification emails to the same account.
+	verificationResendInterval = 2 * time.Minute
+)
+
+// What users whose email isn't verified yet may do, set by UNVERIFIED_LOGIN.
+const (
+	// unverifiedLoginAllow lets them sign in and use everything.
+	unverifiedLoginAllow = "allow"
+	// unverifiedLoginLimited lets them sign in, but account management
+	// endpoints answer 403 until the email is verified.
+	unverifiedLoginLimited = "limited"
+	// unverifiedLoginBlock refuses to sign them in.
+	unverifiedLoginBlock = "block"
+)
+
+var unverifiedLoginPolicy = unverifiedLoginAllow
+
+func loadUnverifiedLoginPolicy() error {
+	policy := os.Getenv("UNVERIFIED_LOGIN")
+	switch policy {
+	case "":
+	case unverifiedLoginAllow, unverifiedLoginLimited, unverifiedLoginBlock:
+		unverifiedLoginPolicy = policy
+	default:
+		return fmt.Errorf("unknown UNVERIFIED_LOGIN: %s", policy)
+	}
+	log.Printf("Unverified email sign-in policy: %s", unverifiedLoginPolicy)
+	return nil
+}
+
+func emailVerified(user User) bool {
+	return user.EmailVerifiedAt != nil
+}
+
+// canSignIn reports whether the verification policy lets user sign in.
+func canSignIn(user User) bool {
+	return emailVerified(user) || unverifiedLoginPolicy != unverifiedLoginBlock
+}
+
+// requireVerifiedUser is currentUser for actions that unverified users may
+// not take under the limited policy. It writes the error response itself.
+func requireVerifiedUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, err := currentUser(r)
+	if err != nil {
+		writeUnauthorized(w, r)
+		return User{}, false
+	}
+	if unverifiedLoginPolicy == unverifiedLoginLimited && !emailVerified(user) {
+		http.Error(w, "Please verify your email address first", http.StatusForbidden)
+		return User{}, false
+	}
+	return user, true
+}
+
+// verifyIdentityEmail marks user's email verified when a provider has
+// verified the same address.
+func verifyIdentityEmail(user *User, identity Identity) {
+	if emailVerified(*user) || !identity.EmailVerified || !strings.EqualFold(identity.Email, user.Email) {
+		return
+	}
+
+	err := userStore.MarkEmailVerified(user.ID, identity.Email)
+	if err != nil {
+		log.Printf("Error marking email verified for %s: %v", user.Username, err)
+		return
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	log.Printf("Email of user %s verified by %s", user.Username, identity.Provider)
+}
+
+// sendVerificationEmail queues a verification link for user's email.
+func sendVerificationEmail(user User) error {
+	secret, err := issueAccountToken(user.ID, tokenPurposeEmailVerification, user.Email, emailVerificationTTL)
+	if err != nil {
+		return fmt.Errorf("error creating verification token: %v", err)
+	}
+
+	return sendEmail("verify_email", user.Email, struct {
+		Username   string
+		Link       string
+		ValidHours int
+	}{
+		Username:   user.Username,
+		Link:       publicURL("/verify?token=" + url.QueryEscape(secret)),
+		ValidHours: int(emailVerificationTTL.Hours()),
+	})
+}
+
+// verificationThrottled reports how long user must wait before another
+// verification email can be sent, zero if it can be sent now.
+func verificationThrottled(user User) (time.Duration, error) {
+	last, err := userStore.LastTokenCreatedAt(user.ID, tokenPurposeEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+	wait := time.Until(last.Add(verificationResendInterval))
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// verifyEmailHandler confirms an email address from a verification link.
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := struct{ Verified bool }{}
+
+	token, err := redeemAccountToken(tokenPurposeEmailVerification, r.URL.Query().Get("token"))
+	if err == nil {
+		err = userStore.MarkEmailVerified(token.UserID, token.Email)
+	}
+	switch err {
+	case nil:
+		log.Printf("Email %s verified for user %d", token.Email, token.UserID)
+		data.Verified = true
+	case ErrTokenInvalid, ErrUserNotFound:
+		// Unknown, expired or used token, or the account's email has
+		// changed since it was sent
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		log.Printf("Error verifying email: %v", err)
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, r, "templates/verify.html", data)
+}
+
+// resendVerificationHandler sends a new verification link, either to the
+// signed-in user or, for users who can't sign in yet, to the account with
+// the given email. The anonymous form answers the same whether or not an
+// account matched.
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		var body struct {
+			Email string `json:"email"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+
+		go resendVerification(body.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If an unverified account exists for that email, a verification link has been sent",
+		})
+		return
+	}
+
+	if user.Email == "" {
+		http.Error(w, "Your account has no email address", http.StatusBadRequest)
+		return
+	}
+	if emailVerified(user) {
+		http.Error(w, "Your email address is already verified", http.StatusConflict)
+		return
+	}
+
+	wait, err := verificationThrottled(user)
+	if err != nil {
+		log.Printf("Error checking verification throttle: %v", err)
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Please wait before requesting another verification email", http.StatusTooManyRequests)
+		return
+	}
+
+	err = sendVerificationEmail(user)
+	if err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+func resendVerification(email string) {
+	user, err := userStore.GetUser(email)
+	if err != nil || !strings.EqualFold(user.Email, email) || emailVerified(user) {
+		log.Printf("Verification resend requested for unknown or verified email: %s", email)
+		return
+	}
+
+	wait, err := verificationThrottled(user)
+	if err != nil || wait > 0 {
+		log.Printf("Verification resend for %s throttled", user.Username)
+		return
+	}
+
+	err = sendVerificationEmail(user)
+	if err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+}
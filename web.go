@@ -12,6 +12,8 @@ const htmlTemplate = `
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
     <title>User Management</title>
+    <meta name="csrf-token" content="{{csrfToken}}">
+    <script src="/static/csrf.js"></script>
     <style>
         body {
             font-family: Arial, sans-serif;
@@ -110,7 +112,13 @@ const htmlTemplate = `
 `
 
 func serveWebPage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.New("webpage").Parse(htmlTemplate)
+	funcs, err := csrfTemplateFuncs(w, r)
+	if err != nil {
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("webpage").Funcs(funcs).Parse(htmlTemplate)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return